@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vijay922/rdns/rdns"
+)
+
+// benchmarkTargets are looked up on every resolver by --benchmark-resolvers
+// unless --benchmark-target is given. They all have long-standing PTR
+// records, so a resolver that fails them is at fault.
+var benchmarkTargets = []string{
+	"8.8.8.8", "8.8.4.4", "1.1.1.1", "1.0.0.1",
+	"9.9.9.9", "149.112.112.112", "208.67.222.222", "208.67.220.220",
+}
+
+// resolverBenchmark is how one resolver did in --benchmark-resolvers.
+type resolverBenchmark struct {
+	resolver string
+	answered int
+	total    int
+	// median is the middle latency of the answered queries.
+	median time.Duration
+}
+
+// benchmarkResolvers looks up every target on each resolver and returns
+// the results fastest first. Each resolver gets one query at a time so
+// its own queries don't slow it down, and up to threads resolvers are
+// measured at once.
+func benchmarkResolvers(ctx context.Context, scanner *rdns.Scanner, resolvers, targets []string, threads int) []resolverBenchmark {
+	results := make([]resolverBenchmark, len(resolvers))
+	forEachResolver(resolvers, threads, func(i int, resolverIP string) {
+		var latencies []time.Duration
+		for _, ip := range targets {
+			if ctx.Err() != nil {
+				break
+			}
+			if _, elapsed, err := scanner.Probe(ctx, resolverIP, ip); err == nil {
+				latencies = append(latencies, elapsed)
+			}
+		}
+
+		results[i] = resolverBenchmark{resolver: resolverIP, answered: len(latencies), total: len(targets)}
+		if len(latencies) > 0 {
+			sort.Slice(latencies, func(a, b int) bool { return latencies[a] < latencies[b] })
+			results[i].median = latencies[len(latencies)/2]
+		}
+	})
+
+	// Resolvers that never answered have no latency, so they go last
+	sort.SliceStable(results, func(a, b int) bool {
+		if (results[a].answered == 0) != (results[b].answered == 0) {
+			return results[b].answered == 0
+		}
+		return results[a].median < results[b].median
+	})
+	return results
+}
+
+// forEachResolver calls probe for every resolver, with its index, running
+// up to threads of them at once, and returns once they have all finished.
+func forEachResolver(resolvers []string, threads int, probe func(i int, resolverIP string)) {
+	slots := make(chan struct{}, threads)
+
+	var wg sync.WaitGroup
+	for i, resolverIP := range resolvers {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			probe(i, resolverIP)
+		}()
+	}
+	wg.Wait()
+}
+
+// printBenchmark writes the --benchmark-resolvers results as a table.
+func printBenchmark(w io.Writer, results []resolverBenchmark) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RESOLVER\tANSWERED\tMEDIAN")
+	for _, b := range results {
+		median := "-"
+		if b.answered > 0 {
+			median = fmt.Sprintf("%.1fms", float64(b.median)/float64(time.Millisecond))
+		}
+		fmt.Fprintf(tw, "%s\t%d/%d (%.0f%%)\t%s\n", b.resolver, b.answered, b.total, 100*float64(b.answered)/float64(b.total), median)
+	}
+	tw.Flush()
+}
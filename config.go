@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/jessevdk/go-flags"
+	"gopkg.in/yaml.v3"
+)
+
+// configArgs reads a --config file, YAML or TOML depending on its
+// extension, and returns its options as command line arguments. Keys are
+// long option names. Options already set on the command line or through
+// the environment are left out, so parsing the result ahead of the real
+// arguments lets both of those win.
+func configArgs(path string, parser *flags.Parser) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]interface{})
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return nil, fmt.Errorf("unknown config format %q, expected .yaml, .yml or .toml", ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Sorted so errors come out in the same order every time
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var args []string
+	for _, key := range keys {
+		option := parser.FindOptionByLongName(key)
+		if option == nil || key == "config" || key == "help" {
+			return nil, fmt.Errorf("unknown option %q", key)
+		}
+		if isExplicit(parser, key) {
+			continue
+		}
+
+		isBool := option.Field().Type.Kind() == reflect.Bool
+		switch value := values[key].(type) {
+		case bool:
+			if !isBool {
+				return nil, fmt.Errorf("%s: expected a value, not %t", key, value)
+			}
+			// A switch can only be turned on from the command line
+			if value {
+				args = append(args, "--"+key)
+			}
+		case []interface{}:
+			if option.Field().Type.Kind() != reflect.Slice {
+				return nil, fmt.Errorf("%s: expected a single value, not a list", key)
+			}
+			for _, item := range value {
+				if !isScalar(item) {
+					return nil, fmt.Errorf("%s: list items must be plain values", key)
+				}
+				args = append(args, fmt.Sprintf("--%s=%v", key, item))
+			}
+		default:
+			if isBool {
+				return nil, fmt.Errorf("%s: expected true or false", key)
+			}
+			if !isScalar(value) {
+				return nil, fmt.Errorf("%s: expected a plain value", key)
+			}
+			args = append(args, fmt.Sprintf("--%s=%v", key, value))
+		}
+	}
+	return args, nil
+}
+
+// isScalar reports whether a decoded config value is a string, number or
+// boolean rather than a list or table.
+func isScalar(value interface{}) bool {
+	switch value.(type) {
+	case []interface{}, map[string]interface{}, nil:
+		return false
+	}
+	return true
+}
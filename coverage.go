@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/vijay922/rdns/rdns"
+)
+
+// histogramWidth is how many characters the bar of a fully covered /24
+// takes up in --coverage-histogram.
+const histogramWidth = 40
+
+// coverage tallies how many of the IPs looked up have a PTR, for
+// --count-only, and for each IPv4 /24 as well with --coverage-histogram.
+// It is only used from the writer goroutine.
+type coverage struct {
+	total    int64
+	resolved int64
+	// blocks is nil unless --coverage-histogram is set.
+	blocks map[[3]byte]*blockCoverage
+}
+
+// blockCoverage is the tally for a single /24.
+type blockCoverage struct {
+	total    int64
+	resolved int64
+}
+
+// jsonCoverage is the --count-only report with --json.
+type jsonCoverage struct {
+	Total    int64           `json:"total"`
+	Resolved int64           `json:"resolved"`
+	Failed   int64           `json:"failed"`
+	Coverage float64         `json:"coverage"`
+	Blocks   []jsonBlockStat `json:"blocks,omitempty"`
+}
+
+// jsonBlockStat is a single /24 of the --coverage-histogram report.
+type jsonBlockStat struct {
+	Block    string  `json:"block"`
+	Total    int64   `json:"total"`
+	Resolved int64   `json:"resolved"`
+	Coverage float64 `json:"coverage"`
+}
+
+func newCoverage(histogram bool) *coverage {
+	c := &coverage{}
+	if histogram {
+		c.blocks = make(map[[3]byte]*blockCoverage)
+	}
+	return c
+}
+
+// add counts result, which has a PTR if it resolved to any hostname.
+func (c *coverage) add(result rdns.Result) {
+	resolved := result.Err == nil && len(result.Hostnames) > 0
+	c.total++
+	if resolved {
+		c.resolved++
+	}
+
+	if c.blocks == nil {
+		return
+	}
+	ip := net.ParseIP(result.IP).To4()
+	if ip == nil {
+		return
+	}
+	key := block24(ip)
+	block := c.blocks[key]
+	if block == nil {
+		block = &blockCoverage{}
+		c.blocks[key] = block
+	}
+	block.total++
+	if resolved {
+		block.resolved++
+	}
+}
+
+// sortedBlocks returns the /24s seen in address order.
+func (c *coverage) sortedBlocks() [][3]byte {
+	keys := make([][3]byte, 0, len(c.blocks))
+	for key := range c.blocks {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		return string(keys[a][:]) < string(keys[b][:])
+	})
+	return keys
+}
+
+// write reports the tallies to w, as JSON or as text such as
+//
+//	Total: 512
+//	With PTR: 300 (58.6%)
+//	Without PTR: 212 (41.4%)
+//
+// followed with --coverage-histogram by a line per /24 like
+// "192.0.2.0/24	200/256	78.1%	###############################".
+func (c *coverage) write(w io.Writer, asJSON bool) error {
+	if asJSON {
+		report := jsonCoverage{
+			Total:    c.total,
+			Resolved: c.resolved,
+			Failed:   c.total - c.resolved,
+			Coverage: percentOf(c.resolved, c.total),
+		}
+		for _, key := range c.sortedBlocks() {
+			block := c.blocks[key]
+			report.Blocks = append(report.Blocks, jsonBlockStat{
+				Block:    blockName(key),
+				Total:    block.total,
+				Resolved: block.resolved,
+				Coverage: percentOf(block.resolved, block.total),
+			})
+		}
+		line, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(line, '\n'))
+		return err
+	}
+
+	failed := c.total - c.resolved
+	if _, err := fmt.Fprintf(w, "Total: %d\nWith PTR: %d (%.1f%%)\nWithout PTR: %d (%.1f%%)\n",
+		c.total, c.resolved, percentOf(c.resolved, c.total), failed, percentOf(failed, c.total)); err != nil {
+		return err
+	}
+	for _, key := range c.sortedBlocks() {
+		block := c.blocks[key]
+		share := percentOf(block.resolved, block.total)
+		bar := strings.Repeat("#", int(share*histogramWidth/100+0.5))
+		if _, err := fmt.Fprintf(w, "%s\t%d/%d\t%.1f%%\t%s\n", blockName(key), block.resolved, block.total, share, bar); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockName writes a /24 in CIDR notation.
+func blockName(key [3]byte) string {
+	return fmt.Sprintf("%d.%d.%d.0/24", key[0], key[1], key[2])
+}
+
+// percentOf is n as a percentage of total, or 0 if total is 0.
+func percentOf(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
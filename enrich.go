@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// asnRecord is the part of a MaxMind ASN database record used by --enrich.
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// lookupASN returns the AS number and organization of ip from asnDB, which
+// is nil unless --enrich is set. The database is memory mapped, so lookups
+// don't touch the disk. IPs missing from the database are left blank.
+func lookupASN(asnDB *maxminddb.Reader, ip string) (uint, string) {
+	if asnDB == nil {
+		return 0, ""
+	}
+
+	var record asnRecord
+	if err := asnDB.Lookup(net.ParseIP(ip), &record); err != nil {
+		return 0, ""
+	}
+	return record.Number, record.Organization
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync/atomic"
+
+	"github.com/vijay922/rdns/rdns"
+)
+
+// neighborExpander feeds the workers for --expand-neighbors. It passes the
+// input on to them and, whenever an IP resolves to a hostname that isn't
+// generic, queues the addresses up to distance below and above it in the
+// same /24 (or the same /120 for IPv6) ahead of the rest of the input.
+// An IP is only queued once while its block is among the last seenBlocks
+// used, and no more than budget neighbors are added in all, if it isn't
+// 0, so a run of hits can't grow without end.
+type neighborExpander struct {
+	scanner  *rdns.Scanner
+	gen      *generator
+	stats    *Stats
+	distance int
+	budget   int
+	added    int
+	// exhausted is set once budget has been reached and warned about.
+	exhausted bool
+
+	// seen holds the IPs queued in each recently used block, keyed by
+	// the address without its last byte. blockOrder has the same keys,
+	// least recently used first.
+	seen       map[string]*blockSeen
+	blockOrder []string
+	queue      []rdns.Target
+	// pending counts the IPs handed to the workers whose results haven't
+	// come back yet. More neighbors may turn up until it is zero.
+	pending int
+}
+
+func newNeighborExpander(scanner *rdns.Scanner, gen *generator, stats *Stats, distance, budget int) *neighborExpander {
+	return &neighborExpander{
+		scanner:  scanner,
+		gen:      gen,
+		stats:    stats,
+		distance: distance,
+		budget:   budget,
+		seen:     make(map[string]*blockSeen),
+	}
+}
+
+// seenBlocks is how many /24s (or /120s) a neighborExpander remembers.
+// The least recently used is forgotten to make room for a new one, so
+// memory stays bounded however large the input is. Input is usually in
+// order, so a forgotten block is rarely seen again, and at worst a few
+// of its addresses are looked up twice.
+const seenBlocks = 4096
+
+// blockSeen marks the addresses queued in a block by their last byte.
+type blockSeen struct {
+	queued   [4]uint64
+	neighbor [4]uint64
+}
+
+// seenKey splits ip into the key of its block and its last byte. ok is
+// false if ip isn't an IP address.
+func seenKey(ip string) (key string, last byte, ok bool) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", 0, false
+	}
+	if v4 := addr.To4(); v4 != nil {
+		addr = v4
+	}
+	return string(addr[:len(addr)-1]), addr[len(addr)-1], true
+}
+
+// wasQueued reports whether ip has been queued, and whether as a
+// neighbor, as far as the blocks still remembered go.
+func (e *neighborExpander) wasQueued(ip string) (queued, neighbor bool) {
+	key, last, ok := seenKey(ip)
+	if !ok {
+		return false, false
+	}
+	block := e.seen[key]
+	if block == nil {
+		return false, false
+	}
+	bit := uint64(1) << (last % 64)
+	return block.queued[last/64]&bit != 0, block.neighbor[last/64]&bit != 0
+}
+
+// queuedNeighbor reports whether ip has already been queued as a
+// neighbor.
+func (e *neighborExpander) queuedNeighbor(ip string) bool {
+	_, neighbor := e.wasQueued(ip)
+	return neighbor
+}
+
+// markQueued records that ip has been queued, forgetting the least
+// recently used block if there are too many.
+func (e *neighborExpander) markQueued(ip string, neighbor bool) {
+	key, last, ok := seenKey(ip)
+	if !ok {
+		return
+	}
+	block := e.seen[key]
+	if block == nil {
+		if len(e.blockOrder) >= seenBlocks {
+			delete(e.seen, e.blockOrder[0])
+			e.blockOrder = e.blockOrder[1:]
+		}
+		block = &blockSeen{}
+		e.seen[key] = block
+		e.blockOrder = append(e.blockOrder, key)
+	} else if e.blockOrder[len(e.blockOrder)-1] != key {
+		// Move it to the back. Ordered input keeps using the newest
+		// block, so this search is rare.
+		for i, k := range e.blockOrder {
+			if k == key {
+				e.blockOrder = append(e.blockOrder[:i], e.blockOrder[i+1:]...)
+				break
+			}
+		}
+		e.blockOrder = append(e.blockOrder, key)
+	}
+
+	bit := uint64(1) << (last % 64)
+	block.queued[last/64] |= bit
+	if neighbor {
+		block.neighbor[last/64] |= bit
+	}
+}
+
+// run moves targets from input to work, queued neighbors first, and
+// results from in to out, until both input and in are closed. work is
+// closed once the input is finished and no result still to come can add
+// more neighbors, or straight away when ctx is done, after which anything
+// left is sent on as Skipped.
+func (e *neighborExpander) run(ctx context.Context, input <-chan rdns.Target, work chan<- rdns.Target, in <-chan rdns.Result, out chan<- rdns.Result) {
+	stopped := false
+	for input != nil || in != nil {
+		if work != nil && input == nil && len(e.queue) == 0 && e.pending == 0 {
+			close(work)
+			work = nil
+		}
+
+		// More input is only read once the neighbors queued so far have
+		// gone out, so the queue stays small
+		var inputCh <-chan rdns.Target
+		if len(e.queue) == 0 || stopped {
+			inputCh = input
+		}
+		var workCh chan<- rdns.Target
+		var next rdns.Target
+		if len(e.queue) > 0 && work != nil {
+			workCh, next = work, e.queue[0]
+		}
+		var done <-chan struct{}
+		if !stopped {
+			done = ctx.Done()
+		}
+
+		select {
+		case target, ok := <-inputCh:
+			switch {
+			case !ok:
+				input = nil
+			case stopped:
+				out <- rdns.Result{IP: target.IP, Skipped: true, Comment: target.Comment}
+			case e.queuedNeighbor(target.IP):
+				// Already looked up as a neighbor
+				atomic.AddInt64(&e.stats.total, -1)
+			default:
+				e.markQueued(target.IP, false)
+				e.queue = append(e.queue, target)
+			}
+		case workCh <- next:
+			e.queue = e.queue[1:]
+			e.pending++
+		case result, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			e.pending--
+			out <- result
+			if !stopped && e.isHit(result) {
+				e.expand(result.IP)
+			}
+		case <-done:
+			stopped = true
+			for _, target := range e.queue {
+				out <- rdns.Result{IP: target.IP, Skipped: true, Comment: target.Comment}
+			}
+			e.queue = nil
+			if work != nil {
+				close(work)
+				work = nil
+			}
+		}
+	}
+}
+
+// isHit reports whether result has a hostname worth sweeping around.
+func (e *neighborExpander) isHit(result rdns.Result) bool {
+	if result.Err != nil || result.Skipped {
+		return false
+	}
+	for _, hostname := range result.Hostnames {
+		if !e.scanner.IsGeneric(hostname, result.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// expand queues the neighbors of ip that haven't been seen yet, nearest
+// first, skipping those that --exclude, --skip-private and the like
+// leave out of the input.
+func (e *neighborExpander) expand(ip string) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return
+	}
+	if v4 := addr.To4(); v4 != nil {
+		addr = v4
+	}
+	last := int(addr[len(addr)-1])
+
+	for d := 1; d <= e.distance; d++ {
+		for _, octet := range []int{last - d, last + d} {
+			if octet < 0 || octet > 255 {
+				continue
+			}
+			neighbor := make(net.IP, len(addr))
+			copy(neighbor, addr)
+			neighbor[len(neighbor)-1] = byte(octet)
+
+			key := neighbor.String()
+			if queued, _ := e.wasQueued(key); queued || e.gen.skipCounter(neighbor) != nil {
+				continue
+			}
+			if e.budget > 0 && e.added >= e.budget {
+				if !e.exhausted {
+					slog.Warn("Reached --max-neighbors, no more neighbors will be queued", "max_neighbors", e.budget)
+					e.exhausted = true
+				}
+				return
+			}
+
+			e.added++
+			e.markQueued(key, true)
+			e.queue = append(e.queue, rdns.Target{IP: key})
+			atomic.AddInt64(&e.stats.total, 1)
+			atomic.AddInt64(&e.stats.neighbors, 1)
+		}
+	}
+}
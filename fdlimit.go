@@ -0,0 +1,48 @@
+package main
+
+import "log/slog"
+
+// fdReserve is how many file descriptors are left over for everything
+// other than queries: stdio, input, output and cache files, log files
+// and the metrics listener.
+const fdReserve = 64
+
+// fdsPerThread estimates how many sockets one thread can have open at
+// once: one per query, times the resolvers a raced query goes to, and
+// twice that with --validate, which looks up A and AAAA together.
+func fdsPerThread(opts *options) int {
+	n := 1
+	if opts.RaceResolvers > 1 {
+		n = opts.RaceResolvers
+	}
+	if opts.Validate {
+		n *= 2
+	}
+	return n
+}
+
+// capThreadsForFDs lowers opts.Threads so the scan stays within the
+// process's open file limit, leaving room for fdReserve and any idle
+// pooled connections to the resolvers. It does nothing if the limit
+// can't be read.
+func capThreadsForFDs(opts *options, resolvers int) {
+	limit, ok := openFileLimit()
+	if !ok {
+		return
+	}
+	slog.Info("Open file limit", "limit", limit)
+
+	budget := int64(limit) - fdReserve - int64(resolvers)*int64(opts.ConnPoolSize+opts.UDPSockets)
+	perThread := int64(fdsPerThread(opts))
+	if int64(opts.Threads)*perThread <= budget {
+		return
+	}
+
+	threads := budget / perThread
+	if threads < 1 {
+		threads = 1
+	}
+	slog.Warn("Lowering --threads to fit the open file limit, raise it with ulimit -n or skip this with --no-fd-check",
+		"threads", opts.Threads, "new_threads", threads, "limit", limit)
+	opts.Threads = int(threads)
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// openFileLimit reports no limit, since there is no RLIMIT_NOFILE to
+// read on this platform.
+func openFileLimit() (uint64, bool) {
+	return 0, false
+}
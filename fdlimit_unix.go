@@ -0,0 +1,19 @@
+//go:build unix
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// openFileLimit returns the soft RLIMIT_NOFILE of the process. Go raises
+// it to the hard limit at startup, so this is already as high as it can
+// go without root.
+func openFileLimit() (uint64, bool) {
+	var rl unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rl); err != nil {
+		return 0, false
+	}
+	if rl.Cur == unix.RLIM_INFINITY {
+		return 0, false
+	}
+	return uint64(rl.Cur), true
+}
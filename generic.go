@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// loadGenericPatterns compiles the --generic-patterns file, which replaces
+// the scanner's built-in patterns. Blank lines and comments are skipped.
+func loadGenericPatterns(filename string) []*regexp.Regexp {
+	file, err := os.Open(filename)
+	if err != nil {
+		fatal("Failed to open generic patterns file", "err", err)
+	}
+	defer file.Close()
+
+	// Non-nil even when empty, so the built-in patterns aren't used instead
+	patterns := []*regexp.Regexp{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		re, err := regexp.Compile(line)
+		if err != nil {
+			fatal("Invalid generic pattern", "pattern", line, "err", err)
+		}
+		patterns = append(patterns, re)
+	}
+
+	if err := scanner.Err(); err != nil {
+		fatal("Failed to read generic patterns file", "err", err)
+	}
+
+	return patterns
+}
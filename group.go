@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/vijay922/rdns/rdns"
+)
+
+// blockGroups holds single IPv4 addresses from the input so that
+// addresses in the same /24 can be queued together for --group-by-24. A
+// /24 is let go once all of its addresses have been read, and the oldest
+// once too many are held, so streamed input keeps flowing and memory
+// stays bounded. The rest go at the end of the input.
+type blockGroups struct {
+	order  [][3]byte
+	blocks map[[3]byte][]heldIP
+	// held counts the addresses in blocks.
+	held int
+	// last is the /24 of the address added most recently.
+	last [3]byte
+}
+
+// Limits on what blockGroups holds before letting the oldest /24 go.
+const (
+	maxGroupBlocks = 1024
+	maxGroupHeld   = 65536
+)
+
+// heldIP is an address waiting in blockGroups, with its input comment.
+type heldIP struct {
+	ip      net.IP
+	comment string
+}
+
+func newBlockGroups() *blockGroups {
+	return &blockGroups{blocks: make(map[[3]byte][]heldIP)}
+}
+
+// add holds on to line, with its comment, if it is a single IPv4 address
+// and reports whether it did. Anything else is left for expandIPRange,
+// since ranges are already generated in order.
+func (g *blockGroups) add(line, comment string) bool {
+	if strings.ContainsAny(line, "/-") {
+		return false
+	}
+	ip := net.ParseIP(line)
+	if isArpa(line) {
+		ip = parseArpa(line)
+	}
+	if ip == nil {
+		return false
+	}
+	return g.addIP(ip, comment)
+}
+
+// addIP holds on to ip, with its comment, if it is an IPv4 address and
+// reports whether it did.
+func (g *blockGroups) addIP(ip net.IP, comment string) bool {
+	if ip = ip.To4(); ip == nil {
+		return false
+	}
+
+	key := block24(ip)
+	if _, ok := g.blocks[key]; !ok {
+		g.order = append(g.order, key)
+	}
+	g.blocks[key] = append(g.blocks[key], heldIP{ip: ip, comment: comment})
+	g.held++
+	g.last = key
+	return true
+}
+
+// flushDue queues the /24 last added to if all its addresses are held,
+// and then the oldest /24s while there are more than maxGroupBlocks or
+// maxGroupHeld addresses. It returns false if ctx was cancelled.
+func (g *blockGroups) flushDue(ctx context.Context, gen *generator, work chan<- rdns.Target) bool {
+	if len(g.blocks[g.last]) >= 256 {
+		for i, key := range g.order {
+			if key == g.last {
+				g.order = append(g.order[:i], g.order[i+1:]...)
+				break
+			}
+		}
+		if !g.queueBlock(ctx, gen, work, g.last) {
+			return false
+		}
+	}
+
+	for len(g.order) > maxGroupBlocks || g.held > maxGroupHeld {
+		key := g.order[0]
+		g.order = g.order[1:]
+		if !g.queueBlock(ctx, gen, work, key) {
+			return false
+		}
+	}
+	return true
+}
+
+// flush queues the held addresses through gen a /24 at a time, in the
+// order each /24 was first seen. It returns false if ctx was cancelled.
+func (g *blockGroups) flush(ctx context.Context, gen *generator, work chan<- rdns.Target) bool {
+	for _, key := range g.order {
+		if !g.queueBlock(ctx, gen, work, key) {
+			return false
+		}
+	}
+	g.order = nil
+	return true
+}
+
+// queueBlock queues the addresses held for the /24 key and forgets them.
+func (g *blockGroups) queueBlock(ctx context.Context, gen *generator, work chan<- rdns.Target, key [3]byte) bool {
+	block := g.blocks[key]
+	delete(g.blocks, key)
+	g.held -= len(block)
+	for _, held := range block {
+		if !gen.queueIP(ctx, work, held.ip, held.comment) {
+			return false
+		}
+	}
+	return true
+}
+
+// block24 returns the /24 an IPv4 address belongs to.
+func block24(ip net.IP) [3]byte {
+	return [3]byte{ip[0], ip[1], ip[2]}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// setupLogging sends log/slog output to stderr at level, as text or, with
+// asJSON, as one JSON object per line for log pipelines.
+func setupLogging(level string, asJSON bool) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: lvl}
+	var handler slog.Handler
+	if asJSON {
+		handler = slog.NewJSONHandler(os.Stderr, handlerOpts)
+	} else {
+		// Someone reading a terminal doesn't need a timestamp per line
+		handlerOpts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		}
+		handler = slog.NewTextHandler(os.Stderr, handlerOpts)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs msg and args as an error and exits with status 1.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+
+	"github.com/vijay922/rdns/rdns"
+)
+
+// lieProbeBlocks are the IPv4 documentation ranges. Nothing is ever
+// assigned in them, so their addresses have no PTR records and an honest
+// resolver answers NXDOMAIN for them.
+var lieProbeBlocks = []string{"192.0.2.", "198.51.100.", "203.0.113."}
+
+// lyingResolver is a resolver that returned a PTR record for an address
+// that has none.
+type lyingResolver struct {
+	resolver string
+	ip       string
+	hostname string
+}
+
+// lieProbeTargets picks a random address in each documentation range, so
+// a resolver can't get away with only faking the answers it expects to be
+// asked for.
+func lieProbeTargets(rng *rand.Rand) []string {
+	targets := make([]string, len(lieProbeBlocks))
+	for i, block := range lieProbeBlocks {
+		targets[i] = fmt.Sprintf("%s%d", block, 1+rng.Intn(254))
+	}
+	return targets
+}
+
+// findLyingResolvers looks up every target on each resolver through the
+// same path as --benchmark-resolvers, and returns the resolvers that
+// answered any of them with a PTR record, in the order given. Failed
+// lookups don't count, since a resolver that is down or slow isn't making
+// answers up.
+func findLyingResolvers(ctx context.Context, scanner *rdns.Scanner, resolvers, targets []string, threads int) []lyingResolver {
+	found := make([]*lyingResolver, len(resolvers))
+	forEachResolver(resolvers, threads, func(i int, resolverIP string) {
+		for _, ip := range targets {
+			if ctx.Err() != nil {
+				return
+			}
+			hostnames, _, err := scanner.Probe(ctx, resolverIP, ip)
+			if err == nil && len(hostnames) > 0 {
+				found[i] = &lyingResolver{resolver: resolverIP, ip: ip, hostname: hostnames[0]}
+				return
+			}
+		}
+	})
+
+	var lying []lyingResolver
+	for _, l := range found {
+		if l != nil {
+			lying = append(lying, *l)
+		}
+	}
+	return lying
+}
+
+// withoutLying returns resolvers less those in lying.
+func withoutLying(resolvers []string, lying []lyingResolver) []string {
+	drop := make(map[string]bool, len(lying))
+	for _, l := range lying {
+		drop[l.resolver] = true
+	}
+	var kept []string
+	for _, resolverIP := range resolvers {
+		if !drop[resolverIP] {
+			kept = append(kept, resolverIP)
+		}
+	}
+	return kept
+}
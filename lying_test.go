@@ -0,0 +1,21 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLieProbeTargetsSeed(t *testing.T) {
+	first := lieProbeTargets(newRand(42))
+	if again := lieProbeTargets(newRand(42)); !reflect.DeepEqual(first, again) {
+		t.Errorf("same seed probed %v, then %v", first, again)
+	}
+
+	// Every range has 254 choices, so a few seeds are enough to differ
+	for seed := int64(1); seed <= 5; seed++ {
+		if !reflect.DeepEqual(first, lieProbeTargets(newRand(seed))) {
+			return
+		}
+	}
+	t.Errorf("seeds 1 to 5 all probed %v, like seed 42", first)
+}
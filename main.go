@@ -2,34 +2,160 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
 	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"math/rand"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
-	"sync"
 	"sync/atomic"
 	"time"
 
 	flags "github.com/jessevdk/go-flags"
+	"github.com/miekg/dns"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/vijay922/rdns/rdns"
+	"golang.org/x/term"
 )
 
-var opts struct {
-	Threads      int    `short:"t" long:"threads" default:"100" description:"How many threads should be used (max 10000)"`
-	ResolverIP   string `short:"r" long:"resolver" description:"IP of the DNS resolver to use for lookups"`
-	ResolverFile string `short:"R" long:"resolvers-file" description:"File containing list of DNS resolvers to use for lookups"`
-	UseDefault   bool   `short:"U" long:"use-default" description:"Use default resolvers for lookups"`
-	Protocol     string `short:"P" long:"protocol" choice:"tcp" choice:"udp" default:"udp" description:"Protocol to use for lookups"`
-	Port         uint16 `short:"p" long:"port" default:"53" description:"Port to bother the specified DNS resolver on"`
-	Domain       bool   `short:"d" long:"domain" description:"Output only domains"`
-	ListFile     string `short:"l" long:"list" description:"File containing IP addresses or CIDR ranges"`
-	Timeout      int    `short:"T" long:"timeout" default:"2" description:"DNS query timeout in seconds"`
-	Retries      int    `short:"y" long:"retries" default:"1" description:"Number of retries per resolver"`
-	Verbose      bool   `short:"v" long:"verbose" description:"Show progress and statistics"`
-	Output       string `short:"o" long:"output" description:"Output file (default: stdout)"`
-	ShowFailed   bool   `short:"f" long:"show-failed" description:"Show failed/unresolved IPs"`
-	RateLimit    int    `short:"L" long:"rate-limit" default:"0" description:"Rate limit in queries per second (0 = no limit)"`
-	Help         bool   `short:"h" long:"help" description:"Show help message"`
+// options holds the command line flags. main fills it in once and passes
+// it to whatever needs it.
+type options struct {
+	Threads            int           `short:"t" long:"threads" env:"RDNS_THREADS" default:"100" description:"How many threads should be used (max 10000)"`
+	ResolverIP         string        `short:"r" long:"resolver" env:"RDNS_RESOLVER" description:"IP of the DNS resolver to use for lookups"`
+	ResolverFile       string        `short:"R" long:"resolvers-file" env:"RDNS_RESOLVERS_FILE" description:"File containing list of DNS resolvers to use for lookups"`
+	StdinResolvers     bool          `long:"resolvers-from-stdin-header" env:"RDNS_RESOLVERS_FROM_STDIN_HEADER" description:"Read resolvers from the lines of stdin before a --- line, and targets from the rest"`
+	UseDefault         bool          `short:"U" long:"use-default" env:"RDNS_USE_DEFAULT" description:"Use default resolvers for lookups"`
+	UseSystem          bool          `long:"use-system" env:"RDNS_USE_SYSTEM" description:"Use the nameservers in /etc/resolv.conf for lookups"`
+	Protocol           string        `short:"P" long:"protocol" env:"RDNS_PROTOCOL" choice:"tcp" choice:"udp" choice:"dot" default:"udp" description:"Protocol to use for lookups (dot = DNS-over-TLS)"`
+	TLSServer          string        `long:"tls-servername" env:"RDNS_TLS_SERVERNAME" description:"Server name to verify DNS-over-TLS certificates against (default: resolver IP)"`
+	Port               uint16        `short:"p" long:"port" env:"RDNS_PORT" default:"53" description:"Port to bother the specified DNS resolver on"`
+	Domain             bool          `short:"d" long:"domain" env:"RDNS_DOMAIN" description:"Output only domains"`
+	ListFiles          []string      `short:"l" long:"list" env:"RDNS_LIST" env-delim:"," description:"File containing IP addresses or CIDR ranges (repeat for several files)"`
+	SkipMissing        bool          `long:"skip-missing" env:"RDNS_SKIP_MISSING" description:"Warn about and skip --list files that don't exist instead of stopping"`
+	Timeout            int           `short:"T" long:"timeout" env:"RDNS_TIMEOUT" default:"2" description:"DNS query timeout in seconds"`
+	Timeout6           int           `long:"timeout6" env:"RDNS_TIMEOUT6" default:"0" description:"DNS query timeout in seconds for IPv6 addresses (0 = same as --timeout)"`
+	RetriesPerResolver int           `short:"y" long:"retries-per-resolver" env:"RDNS_RETRIES_PER_RESOLVER" default:"1" description:"Number of retries per resolver"`
+	Retries            int           `long:"retries" hidden:"yes" description:"Old name for --retries-per-resolver"`
+	MaxResolvers       int           `long:"max-resolvers-to-try" env:"RDNS_MAX_RESOLVERS_TO_TRY" default:"0" description:"Give up on an IP after trying this many resolvers (0 = all of them)"`
+	MaxQueries         int64         `long:"max-queries" env:"RDNS_MAX_QUERIES" default:"0" description:"Stop the run once this many PTR queries have been sent, retries included (0 = no limit)"`
+	MaxDuration        time.Duration `long:"max-duration" env:"RDNS_MAX_DURATION" default:"0" description:"Stop the run after this long, e.g. 10m, keeping results so far (0 = no limit)"`
+	PerIPTimeout       time.Duration `long:"per-ip-timeout" env:"RDNS_PER_IP_TIMEOUT" default:"0" description:"Give up on an IP once all its attempts together take this long, e.g. 10s (0 = no limit)"`
+	ProgressInterval   time.Duration `long:"progress-interval" env:"RDNS_PROGRESS_INTERVAL" default:"5s" description:"How often -v prints a progress line, e.g. 1s or 30s"`
+	LogSlow            time.Duration `long:"log-slow" env:"RDNS_LOG_SLOW" default:"0" description:"Log each query that takes longer than this to stderr, with the IP and resolver, e.g. 500ms (0 = off)"`
+	Verbose            bool          `short:"v" long:"verbose" env:"RDNS_VERBOSE" description:"Show progress and statistics"`
+	Quiet              bool          `short:"q" long:"quiet" env:"RDNS_QUIET" description:"Only write errors to stderr, without warnings or the summary after an interruption (the opposite of -v)"`
+	LogLevel           string        `long:"log-level" env:"RDNS_LOG_LEVEL" default:"warn" choice:"debug" choice:"info" choice:"warn" choice:"error" description:"Lowest level of log message to show (-v raises the default to info)"`
+	NoFDCheck          bool          `long:"no-fd-check" env:"RDNS_NO_FD_CHECK" description:"Don't lower --threads to fit the open file limit"`
+	LogJSON            bool          `long:"log-json" env:"RDNS_LOG_JSON" description:"Write log messages to stderr as JSON, one object per line"`
+	Output             string        `short:"o" long:"output" env:"RDNS_OUTPUT" description:"Output file (default: stdout)"`
+	Tee                bool          `long:"tee" env:"RDNS_TEE" description:"Write the output to stdout as well as to --output"`
+	Syslog             bool          `long:"syslog" env:"RDNS_SYSLOG" description:"Send each output line to syslog as its own message instead of writing it to stdout"`
+	SyslogAddr         string        `long:"syslog-addr" env:"RDNS_SYSLOG_ADDR" description:"Remote syslog server for --syslog, as host:port for UDP or tcp://host:port (default: the local syslog daemon)"`
+	SyslogPriority     string        `long:"syslog-priority" env:"RDNS_SYSLOG_PRIORITY" default:"user.info" description:"Facility and severity of --syslog messages, e.g. local0.notice"`
+	Append             bool          `long:"append" env:"RDNS_APPEND" description:"Append to --output and --failed-output instead of truncating them"`
+	OutputRotateLines  int64         `long:"output-rotate-lines" env:"RDNS_OUTPUT_ROTATE_LINES" default:"0" description:"Start a new --output file, numbered .1, .2 and so on, after this many lines (0 = never)"`
+	OutputRotateSize   int64         `long:"output-rotate-size" env:"RDNS_OUTPUT_ROTATE_SIZE" default:"0" description:"Start a new --output file, numbered .1, .2 and so on, once one reaches this many bytes (0 = never)"`
+	OutputBuffer       int           `long:"output-buffer" env:"RDNS_OUTPUT_BUFFER" default:"65536" description:"Output buffer size in bytes, flushed every second (0 = unbuffered)"`
+	ShowFailed         bool          `short:"f" long:"show-failed" env:"RDNS_SHOW_FAILED" description:"Show failed/unresolved IPs"`
+	OnlyWithPTR        bool          `long:"only-with-ptr" env:"RDNS_ONLY_WITH_PTR" description:"Only output IPs that have a PTR record, never failures"`
+	OnlyWithoutPTR     bool          `long:"only-without-ptr" env:"RDNS_ONLY_WITHOUT_PTR" description:"Only output IPs that failed on every resolver, one plain IP per line"`
+	RemainingOutput    string        `long:"remaining-output" env:"RDNS_REMAINING_OUTPUT" description:"Write IPs left unprocessed when the run is stopped early to this file"`
+	FailedOutput       string        `long:"failed-output" env:"RDNS_FAILED_OUTPUT" description:"Write failed IPs and their last error to this file instead of the main output"`
+	Raw                bool          `long:"raw" env:"RDNS_RAW" description:"Send raw PTR queries to expose TTL, authority and truncation details"`
+	ExtraRecords       []string      `long:"extra-records" env:"RDNS_EXTRA_RECORDS" env-delim:"," description:"Also look up these record types for every hostname found, e.g. A,AAAA,TXT (requires --raw, shown with --json)"`
+	NoRecursion        bool          `long:"no-recursion" env:"RDNS_NO_RECURSION" description:"Clear the recursion desired flag on PTR queries, for querying authoritative servers directly (requires --raw)"`
+	DNSSEC             bool          `long:"dnssec" env:"RDNS_DNSSEC" description:"Set the DNSSEC OK, authenticated data and checking disabled flags on PTR queries (requires --raw)"`
+	ECS                string        `long:"ecs" env:"RDNS_ECS" description:"Send this client subnet with every query as an EDNS0 option, e.g. 203.0.113.0/24 (requires --raw)"`
+	Proxy              string        `long:"proxy" env:"RDNS_PROXY" description:"Send lookups through this SOCKS5 proxy, e.g. socks5://127.0.0.1:1080 (requires -P tcp or -P dot)"`
+	SourceIP           string        `long:"source-ip" env:"RDNS_SOURCE_IP" description:"Send queries from this local address, on machines with more than one"`
+	NoColor            bool          `long:"no-color" env:"RDNS_NO_COLOR" description:"Don't color hostnames and failures when writing to a terminal"`
+	JSON               bool          `long:"json" env:"RDNS_JSON" description:"Output one JSON object per line"`
+	JSONFlatten        bool          `long:"json-flatten" env:"RDNS_JSON_FLATTEN" description:"Like --json, but with one object per hostname instead of a ptr array"`
+	CSV                bool          `long:"csv" env:"RDNS_CSV" description:"Output CSV with a header row"`
+	BinaryOutput       string        `long:"binary-output" env:"RDNS_BINARY_OUTPUT" optional:"yes" optional-value:"ipv4" choice:"ipv4" choice:"ipv6" description:"Write only the addresses that resolved, packed into 4 bytes each, or 16 bytes each with --binary-output=ipv6"`
+	FormatCompat       string        `long:"format-compat" env:"RDNS_FORMAT_COMPAT" choice:"massdns" choice:"dnsx" description:"Write records the way massdns (-o S) or dnsx (-ptr -resp) does, for feeding tools that read their output"`
+	Format             string        `long:"format" env:"RDNS_FORMAT" description:"Output template, e.g. \"{ip} {ptr} [{resolver}]\" (placeholders: ip, ptr, resolver, ttl, verified)"`
+	Enrich             bool          `long:"enrich" env:"RDNS_ENRICH" description:"Add the ASN and organization of each resolved IP, from --asn-db"`
+	ASNDB              string        `long:"asn-db" env:"RDNS_ASN_DB" description:"MaxMind-format ASN database for --enrich, e.g. GeoLite2-ASN.mmdb"`
+	PadIP              bool          `long:"pad-ip" env:"RDNS_PAD_IP" description:"Write IPv4 addresses zero padded and IPv6 addresses in full, so the output sorts as text"`
+	Lowercase          bool          `long:"lowercase" env:"RDNS_LOWERCASE" description:"Lowercase hostnames before writing them, as resolvers may return them in any case"`
+	UniqueOutput       bool          `long:"unique-output" env:"RDNS_UNIQUE_OUTPUT" description:"Write each output line only once, e.g. each hostname once with -d"`
+	UniqueApprox       bool          `long:"unique-approx" env:"RDNS_UNIQUE_APPROX" description:"Like --unique-output, but in a fixed 16 MiB of memory, at the cost of occasionally dropping a line that wasn't a repeat"`
+	ShowResolver       bool          `long:"show-resolver" env:"RDNS_SHOW_RESOLVER" description:"Append the resolver that answered as a trailing column"`
+	Validate           bool          `long:"validate" env:"RDNS_VALIDATE" description:"Forward-confirm each PTR and mark results VERIFIED or UNVERIFIED"`
+	SkipGeneric        bool          `long:"skip-generic" env:"RDNS_SKIP_GENERIC" description:"Suppress generic placeholder hostnames such as 1-2-3-4.static.example.com"`
+	GenericFile        string        `long:"generic-patterns" env:"RDNS_GENERIC_PATTERNS" description:"File of regular expressions matching generic hostnames (replaces the built-in set)"`
+	MaxPTRRecords      int           `long:"max-ptr-records" env:"RDNS_MAX_PTR_RECORDS" default:"0" description:"Write at most this many hostnames per IP (0 = all), marking capped IPs (+N more) in text, in a dropped_ptr CSV column and with ptr_truncated in JSON"`
+	ShuffleResolvers   bool          `long:"shuffle-resolvers" env:"RDNS_SHUFFLE_RESOLVERS" description:"Give each worker its own randomly ordered resolver list instead of rotating"`
+	Seed               int64         `long:"seed" env:"RDNS_SEED" default:"0" description:"Seed for random choices, for reproducible runs (0 = random)"`
+	EjectAfter         int           `long:"eject-after" env:"RDNS_EJECT_AFTER" default:"0" description:"Take a resolver out of rotation after this many consecutive failures (0 = never)"`
+	EjectCooldown      time.Duration `long:"eject-cooldown" env:"RDNS_EJECT_COOLDOWN" default:"30s" description:"How long an ejected resolver stays out of rotation"`
+	RetryStrategy      string        `long:"retry-strategy" env:"RDNS_RETRY_STRATEGY" default:"same-first" choice:"same-first" choice:"rotate-first" description:"Spend --retries-per-resolver on each resolver before moving on (same-first), or move on straight away and retry in later passes over the list (rotate-first)"`
+	FailOn             string        `long:"fail-on" env:"RDNS_FAIL_ON" default:"all-failure" choice:"none" choice:"any-failure" choice:"all-failure" description:"When lookup failures make the exit status nonzero: if every IP failed, if any did, or never"`
+	RetryPasses        int           `long:"retry-failed-passes" env:"RDNS_RETRY_FAILED_PASSES" default:"0" description:"After the scan, look up the IPs that failed (other than NXDOMAIN) again, up to this many more times"`
+	CountOnly          bool          `long:"count-only" env:"RDNS_COUNT_ONLY" description:"Don't write a line per IP, only how many IPs have a PTR once the scan ends"`
+	CoverageHistogram  bool          `long:"coverage-histogram" env:"RDNS_COVERAGE_HISTOGRAM" description:"With --count-only, also show how many IPs in each /24 have a PTR"`
+	ReportDisagree     bool          `long:"report-disagreement" env:"RDNS_REPORT_DISAGREEMENT" description:"Ask every resolver about each IP, and add a DISAGREE record listing each resolver's answer when they differ"`
+	QueryAll           bool          `long:"query-all-resolvers" env:"RDNS_QUERY_ALL_RESOLVERS" description:"Ask every resolver about each IP and merge the hostnames they return, logging disagreements with -v"`
+	RaceResolvers      int           `long:"race-resolvers" env:"RDNS_RACE_RESOLVERS" default:"0" description:"Send each query to this many resolvers at once and take the first answer (0 or 1 = one at a time)"`
+	RateLimit          int           `short:"L" long:"rate-limit" env:"RDNS_RATE_LIMIT" default:"0" description:"Rate limit in queries per second to each resolver (0 = no limit)"`
+	MaxInflight        int           `long:"max-inflight-per-resolver" env:"RDNS_MAX_INFLIGHT_PER_RESOLVER" default:"0" description:"Maximum simultaneous queries to any one resolver (0 = no limit)"`
+	ConnPoolSize       int           `long:"conn-pool-size" env:"RDNS_CONN_POOL_SIZE" default:"0" description:"Keep up to this many idle TCP or DoT connections to each resolver and reuse them for later queries (0 = a new connection per query)"`
+	UDPSockets         int           `long:"udp-sockets" env:"RDNS_UDP_SOCKETS" default:"0" description:"Keep up to this many UDP sockets open to each resolver and reuse them for later queries (0 = a new socket per query, requires --raw)"`
+	GlobalRate         int           `long:"global-rate-limit" env:"RDNS_GLOBAL_RATE_LIMIT" default:"0" description:"Rate limit in IPs per second across all resolvers (0 = no limit)"`
+	RateJitter         int           `long:"rate-jitter" env:"RDNS_RATE_JITTER" default:"0" description:"Vary the spacing of rate limited queries by up to this percentage either way (0-100)"`
+	GroupBy24          bool          `long:"group-by-24" env:"RDNS_GROUP_BY_24" description:"Queue single IPs a /24 at a time and send each /24 to the same resolver first, for better cache hits"`
+	ShuffleInput       bool          `long:"shuffle-input" env:"RDNS_SHUFFLE_INPUT" description:"Query the input addresses in random order instead of sequentially, within --shuffle-window"`
+	ShuffleWindow      int           `long:"shuffle-window" env:"RDNS_SHUFFLE_WINDOW" default:"65536" description:"How many addresses --shuffle-input holds in memory to pick from"`
+	SampleRate         float64       `long:"sample-rate" env:"RDNS_SAMPLE_RATE" default:"1" description:"Fraction of input IPs to query, picked at random, e.g. 0.01 (1 = all)"`
+	ExcludeFile        string        `long:"exclude" env:"RDNS_EXCLUDE" description:"File of IPs or CIDR ranges to skip"`
+	IncludeDomains     []string      `long:"include-domain" env:"RDNS_INCLUDE_DOMAIN" env-delim:"," description:"Only output hostnames in this domain or under it (repeatable)"`
+	ExcludeDomains     []string      `long:"exclude-domain" env:"RDNS_EXCLUDE_DOMAIN" env-delim:"," description:"Leave hostnames in this domain or under it out of the output (repeatable)"`
+	SkipPrivate        bool          `long:"skip-private" env:"RDNS_SKIP_PRIVATE" description:"Skip private, loopback, link-local and documentation addresses instead of querying them"`
+	IncludePrivate     bool          `long:"include-private" env:"RDNS_INCLUDE_PRIVATE" description:"Query private and reserved addresses even if --skip-private is given"`
+	OnlyIPv4           bool          `long:"only-ipv4" env:"RDNS_ONLY_IPV4" description:"Only query IPv4 addresses, skipping IPv6 ones in the input"`
+	OnlyIPv6           bool          `long:"only-ipv6" env:"RDNS_ONLY_IPV6" description:"Only query IPv6 addresses, skipping IPv4 ones in the input"`
+	CacheSize          int           `long:"cache-size" env:"RDNS_CACHE_SIZE" default:"0" description:"Remember this many resolved IPs so repeats in the input aren't queried again (0 = no cache, or no limit with --cache-file)"`
+	CacheFile          string        `long:"cache-file" env:"RDNS_CACHE_FILE" description:"Load the cache from this file at startup and save it on exit"`
+	CacheTTL           time.Duration `long:"cache-ttl" env:"RDNS_CACHE_TTL" default:"0" description:"Re-query cached IPs once their entry is older than this, e.g. 24h (0 = never)"`
+	CacheUseTTL        bool          `long:"cache-use-ttl" env:"RDNS_CACHE_USE_TTL" description:"Re-query cached IPs once the TTL of their PTR records has elapsed, or --cache-ttl if that comes first (requires --raw)"`
+	MaxLineLength      int           `long:"max-line-length" env:"RDNS_MAX_LINE_LENGTH" default:"16777216" description:"Longest input line accepted, in bytes"`
+	ExpandNeighbors    int           `long:"expand-neighbors" env:"RDNS_EXPAND_NEIGHBORS" default:"0" description:"When an IP has a PTR that isn't generic, also look up this many addresses on either side of it in its /24"`
+	MaxNeighbors       int           `long:"max-neighbors" env:"RDNS_MAX_NEIGHBORS" default:"65536" description:"Most addresses --expand-neighbors adds to a run (0 = no limit)"`
+	MaxExpand          int64         `long:"max-expand" env:"RDNS_MAX_EXPAND" default:"16777216" description:"Skip, with an error, any range that would expand to more addresses than this, e.g. a mistyped 0.0.0.0/0 (0 = no limit)"`
+	Force              bool          `long:"force" env:"RDNS_FORCE" description:"Query ranges larger than --max-expand instead of skipping them"`
+	MaxHosts           int           `long:"max-hosts" env:"RDNS_MAX_HOSTS" default:"65536" description:"Maximum addresses to enumerate from a single IPv6 range (0 = no limit)"`
+	ForwardFirst       bool          `long:"forward-first" env:"RDNS_FORWARD_FIRST" description:"Treat input lines that aren't IPs as hostnames, and look up the PTRs of the IPs they resolve to"`
+	BinaryInput        string        `long:"binary-input" env:"RDNS_BINARY_INPUT" optional:"yes" optional-value:"ipv4" choice:"ipv4" choice:"ipv6" description:"Read the input as packed addresses, 4 bytes each, or 16 bytes each with --binary-input=ipv6, instead of text"`
+	Comments           bool          `long:"passthrough-comments" env:"RDNS_PASSTHROUGH_COMMENTS" description:"Carry any # comment after an input target through to the output lines for it"`
+	DryRun             bool          `long:"dry-run" env:"RDNS_DRY_RUN" description:"Print the IPs that would be queried, after excludes and sampling, without sending any queries"`
+	BenchmarkResolvers bool          `long:"benchmark-resolvers" env:"RDNS_BENCHMARK_RESOLVERS" description:"Time a few known PTR lookups on each resolver, print a table of how many each answered and how fast, and exit"`
+	BenchmarkTargets   []string      `long:"benchmark-target" env:"RDNS_BENCHMARK_TARGET" env-delim:"," description:"IP to look up with --benchmark-resolvers instead of the built-in set (repeatable)"`
+	DetectLying        bool          `long:"detect-lying-resolvers" env:"RDNS_DETECT_LYING_RESOLVERS" description:"Before scanning, warn about resolvers that return PTRs for random addresses that have none"`
+	DropLying          bool          `long:"drop-lying-resolvers" env:"RDNS_DROP_LYING_RESOLVERS" description:"Like --detect-lying-resolvers, but also leave those resolvers out of the scan"`
+	SummaryJSON        string        `long:"summary-json" env:"RDNS_SUMMARY_JSON" optional:"yes" optional-value:"-" description:"Print a JSON summary at the end of the run to stderr, or to the given file"`
+	ResolverStatsFile  string        `long:"resolver-stats-file" env:"RDNS_RESOLVER_STATS_FILE" description:"Write the queries, successes and timeouts of each resolver to this file as CSV at the end of the run"`
+	MetricsAddr        string        `long:"metrics-addr" env:"RDNS_METRICS_ADDR" description:"Serve Prometheus metrics on this address, e.g. :9090"`
+	Config             string        `long:"config" env:"RDNS_CONFIG" description:"Read options from this YAML (.yaml, .yml) or TOML (.toml) file, keyed by long option name"`
+	Help               bool          `short:"h" long:"help" description:"Show help message"`
 }
 
 var defaultResolvers = []string{
@@ -39,16 +165,103 @@ var defaultResolvers = []string{
 	"76.76.19.19", "76.223.122.150", "94.140.14.14", "94.140.15.15",
 }
 
+// reservedRanges are the carrier-grade NAT space of RFC 6598 and the
+// documentation ranges of RFC 5737 and RFC 3849, which --skip-private
+// leaves out along with the ranges net.IP already knows about.
+var reservedRanges = []*net.IPNet{
+	{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)},
+	{IP: net.IPv4(192, 0, 2, 0), Mask: net.CIDRMask(24, 32)},
+	{IP: net.IPv4(198, 51, 100, 0), Mask: net.CIDRMask(24, 32)},
+	{IP: net.IPv4(203, 0, 113, 0), Mask: net.CIDRMask(24, 32)},
+	{IP: net.IP{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Mask: net.CIDRMask(32, 128)},
+}
+
+// isPrivate reports whether ip is private, loopback, link-local,
+// unspecified or in reservedRanges, none of which have public PTR records
+// worth querying.
+func isPrivate(ip net.IP) bool {
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, ipnet := range reservedRanges {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isExplicit reports whether the option with the given long name was set
+// on the command line or through its RDNS_ environment variable, rather
+// than left at its default. go-flags treats both defaults and environment
+// variables as defaults, so the variable is checked for separately.
+func isExplicit(parser *flags.Parser, longName string) bool {
+	option := parser.FindOptionByLongName(longName)
+	if !option.IsSetDefault() {
+		return option.IsSet()
+	}
+	_, ok := os.LookupEnv(option.EnvKeyWithNamespace())
+	return ok
+}
+
+// Stats counts the input side of a run. Lookup counts are kept by the
+// scanner.
 type Stats struct {
-	total     int64
-	resolved  int64
-	failed    int64
-	processed int64
+	total    int64
+	excluded int64
+	// private counts addresses left out by --skip-private.
+	private int64
+	// otherFamily counts addresses left out by --only-ipv4 or --only-ipv6.
+	otherFamily int64
+	// unresolved counts --forward-first hostnames that didn't resolve.
+	unresolved int64
+	// invalid counts input lines that aren't a valid IP, CIDR or range.
+	invalid int64
+	// domainNotIncluded and domainExcluded count hostnames left out of
+	// the output by --include-domain and --exclude-domain.
+	domainNotIncluded int64
+	domainExcluded    int64
+	// neighbors counts the IPs queued by --expand-neighbors.
+	neighbors int64
+	// recovered counts failed IPs that resolved on a --retry-failed-passes
+	// pass.
+	recovered int64
+	// inputDone is set once every IP has been queued, after which total
+	// is final.
+	inputDone int32
 }
 
-var stats Stats
+// generator reads targets from the input and queues each address they
+// describe for lookup. It is only used from the generator goroutine.
+type generator struct {
+	opts  *options
+	stats *Stats
+	// excludes holds the ranges loaded from --exclude.
+	excludes []*net.IPNet
+	// sampler picks the IPs kept by --sample-rate. It is nil when every
+	// IP is kept.
+	sampler *rand.Rand
+	// shuffler reorders the IPs for --shuffle-input, and is nil
+	// otherwise.
+	shuffler *inputShuffler
+	// leftovers receives IPs read from the input after the run was
+	// stopped, when --remaining-output is set. It is nil otherwise, and
+	// the input is simply abandoned.
+	leftovers chan<- rdns.Result
+
+	// scanner looks up the hostnames in the input for --forward-first,
+	// and failures receives those that don't resolve. seen holds the IPs
+	// already queued from hostnames so each is only looked up once.
+	scanner  *rdns.Scanner
+	failures chan<- rdns.Result
+	seen     map[string]bool
+}
 
 func main() {
+	var opts options
+	stats := &Stats{}
+	gen := &generator{opts: &opts, stats: stats}
+
 	parser := flags.NewParser(&opts, flags.Default)
 	_, err := parser.Parse()
 
@@ -56,6 +269,20 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Parse again with the config file's options ahead of the real ones
+	if opts.Config != "" {
+		args, err := configArgs(opts.Config, parser)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --config %s: %v\n", opts.Config, err)
+			os.Exit(1)
+		}
+		opts = options{}
+		parser = flags.NewParser(&opts, flags.Default)
+		if _, err := parser.ParseArgs(append(args, os.Args[1:]...)); err != nil {
+			os.Exit(1)
+		}
+	}
+
 	if opts.Help {
 		parser.WriteHelp(os.Stdout)
 		fmt.Println("\nExamples:")
@@ -65,282 +292,1861 @@ func main() {
 		os.Exit(0)
 	}
 
+	// -v shows info messages too and -q only errors, unless a level was
+	// asked for
+	if opts.Verbose && opts.Quiet {
+		fmt.Fprintln(os.Stderr, "Error: --verbose and --quiet cannot be used together")
+		os.Exit(1)
+	}
+	if !isExplicit(parser, "log-level") {
+		if opts.Verbose {
+			opts.LogLevel = "info"
+		}
+		if opts.Quiet {
+			opts.LogLevel = "error"
+		}
+	}
+	if err := setupLogging(opts.LogLevel, opts.LogJSON); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid --log-level: %v\n", err)
+		os.Exit(1)
+	}
+
+	// DNS-over-TLS listens on 853 unless told otherwise
+	if opts.Protocol == "dot" && !isExplicit(parser, "port") {
+		opts.Port = 853
+	}
+
+	if opts.IncludePrivate {
+		opts.SkipPrivate = false
+	}
+
+	if opts.OnlyIPv4 && opts.OnlyIPv6 {
+		fatal("--only-ipv4 and --only-ipv6 cannot be used together")
+	}
+
+	if parser.FindOptionByLongName("retries").IsSet() {
+		opts.RetriesPerResolver = opts.Retries
+	}
+
+	if opts.SampleRate <= 0 || opts.SampleRate > 1 {
+		fatal("--sample-rate must be greater than 0 and at most 1")
+	}
+	if opts.SampleRate < 1 {
+		gen.sampler = newRand(opts.Seed)
+	}
+
+	if opts.ShuffleInput {
+		if opts.GroupBy24 {
+			fatal("--shuffle-input and --group-by-24 cannot be used together")
+		}
+		if opts.ShuffleWindow < 1 {
+			fatal("--shuffle-window must be at least 1")
+		}
+		gen.shuffler = newInputShuffler(opts.ShuffleWindow, newRand(opts.Seed))
+	}
+
+	if opts.ProgressInterval <= 0 {
+		fatal("--progress-interval must be positive")
+	}
+
+	if opts.RateJitter < 0 || opts.RateJitter > 100 {
+		fatal("--rate-jitter must be between 0 and 100")
+	}
+
+	if opts.RetryPasses < 0 {
+		fatal("--retry-failed-passes cannot be negative")
+	}
+
+	if opts.ConnPoolSize < 0 {
+		fatal("--conn-pool-size cannot be negative")
+	}
+	if opts.UDPSockets < 0 {
+		fatal("--udp-sockets cannot be negative")
+	}
+
 	// Validate thread count
+	if opts.Threads < 1 {
+		fatal("--threads must be at least 1")
+	}
 	if opts.Threads > 10000 {
-		fmt.Fprintf(os.Stderr, "Warning: Thread count limited to 10000 for system stability\n")
+		slog.Warn("Thread count limited to 10000 for system stability")
 		opts.Threads = 10000
 	}
 
 	// Setup resolvers
 	var resolvers []string
+	var stdin io.Reader = os.Stdin
+	if opts.StdinResolvers {
+		if len(opts.ListFiles) > 0 {
+			fatal("--resolvers-from-stdin-header reads targets from stdin and can't be used with -l")
+		}
+		resolvers, stdin = readStdinHeader(os.Stdin, &opts)
+	}
+
 	if opts.ResolverFile != "" {
-		resolvers = loadResolversFromFile(opts.ResolverFile)
+		resolvers = loadResolversFromFile(opts.ResolverFile, &opts)
+		if len(resolvers) == 0 {
+			fatal("No valid resolvers", "file", opts.ResolverFile)
+		}
 	}
 
 	if opts.ResolverIP != "" {
-		resolvers = append(resolvers, opts.ResolverIP)
+		resolver, err := parseResolverEntry(opts.ResolverIP, &opts)
+		if err != nil {
+			fatal("Invalid resolver", "resolver", opts.ResolverIP, "err", err)
+		}
+		resolvers = append(resolvers, resolver)
 	}
 
 	if opts.UseDefault {
 		resolvers = append(resolvers, defaultResolvers...)
 	}
 
+	if opts.UseSystem {
+		resolvers = append(resolvers, loadSystemResolvers(&opts)...)
+	}
+
+	if opts.ExcludeFile != "" {
+		gen.excludes = loadExcludes(opts.ExcludeFile, opts.MaxLineLength)
+	}
+
 	if len(resolvers) == 0 {
-		fmt.Fprintf(os.Stderr, "Error: No DNS resolvers specified. Use -r, -R, or -U\n")
-		os.Exit(1)
+		// Nothing else is needed just to list the targets, unless they
+		// include hostnames to look up
+		if opts.DryRun && !opts.ForwardFirst {
+			dryRun(gen, stdin)
+			return
+		}
+		fatal("No DNS resolvers specified. Use -r, -R, -U or --use-system")
 	}
+	resolvers, weights := weighResolvers(resolvers)
 
-	if opts.Verbose {
-		fmt.Fprintf(os.Stderr, "Using %d resolvers with %d threads\n", len(resolvers), opts.Threads)
+	var asnDB *maxminddb.Reader
+	if opts.Enrich {
+		if opts.ASNDB == "" {
+			fatal("--enrich needs an ASN database, given with --asn-db")
+		}
+		asnDB, err = maxminddb.Open(opts.ASNDB)
+		if err != nil {
+			fatal("Failed to open ASN database", "err", err)
+		}
+		defer asnDB.Close()
 	}
 
-	// Setup output
-	var outputFile *os.File
-	if opts.Output != "" {
-		outputFile, err = os.Create(opts.Output)
+	var ecs *net.IPNet
+	if opts.ECS != "" {
+		if !opts.Raw {
+			fatal("--ecs requires --raw")
+		}
+		_, ecs, err = net.ParseCIDR(opts.ECS)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to create output file: %v\n", err)
-			os.Exit(1)
+			fatal("Invalid --ecs subnet", "subnet", opts.ECS)
 		}
-		defer outputFile.Close()
-	} else {
-		outputFile = os.Stdout
 	}
 
-	// Setup rate limiting
-	var rateLimiter <-chan time.Time
-	if opts.RateLimit > 0 {
-		ticker := time.NewTicker(time.Second / time.Duration(opts.RateLimit))
-		defer ticker.Stop()
-		rateLimiter = ticker.C
+	if opts.ReportDisagree {
+		if opts.RaceResolvers > 1 {
+			fatal("--report-disagreement cannot be used with --race-resolvers")
+		}
+		if opts.CSV || opts.Format != "" || opts.BinaryOutput != "" || opts.Domain || opts.OnlyWithoutPTR {
+			fatal("--report-disagreement cannot be used with --csv, --format, --binary-output, -d or --only-without-ptr")
+		}
+		opts.QueryAll = true
+	}
+	if opts.QueryAll && opts.RaceResolvers > 1 {
+		fatal("--query-all-resolvers cannot be used with --race-resolvers")
 	}
 
-	// Create work channel with buffer
-	work := make(chan string, opts.Threads*2)
-	
-	// Start progress reporter if verbose
-	var progressDone chan bool
-	if opts.Verbose {
-		progressDone = make(chan bool)
-		go showProgress(progressDone)
+	if opts.NoRecursion && !opts.Raw {
+		fatal("--no-recursion requires --raw")
+	}
+	if opts.UDPSockets > 0 && !opts.Raw {
+		fatal("--udp-sockets requires --raw")
+	}
+	if opts.DNSSEC && !opts.Raw {
+		fatal("--dnssec requires --raw")
 	}
 
-	// Start IP generator
-	go func() {
-		defer close(work)
-		
-		if opts.ListFile != "" {
-			generateIPsFromFile(opts.ListFile, work)
-		} else {
-			generateIPsFromStdin(work)
+	var extraTypes []uint16
+	for _, list := range opts.ExtraRecords {
+		if !opts.Raw {
+			fatal("--extra-records requires --raw")
 		}
-	}()
+		for _, name := range strings.Split(list, ",") {
+			qtype, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(name))]
+			if !ok {
+				fatal("Unknown record type in --extra-records", "type", name)
+			}
+			extraTypes = append(extraTypes, qtype)
+		}
+	}
+
+	var proxyURL *url.URL
+	if opts.Proxy != "" {
+		if opts.Protocol == "udp" {
+			fatal("--proxy can't carry UDP, use -P tcp or -P dot")
+		}
+		proxyURL, err = url.Parse(opts.Proxy)
+		if err != nil || (proxyURL.Scheme != "socks5" && proxyURL.Scheme != "socks5h") || proxyURL.Host == "" {
+			fatal("Invalid --proxy, expected socks5://host:port", "proxy", opts.Proxy)
+		}
+	}
+
+	var sourceIP net.IP
+	if opts.SourceIP != "" {
+		sourceIP = net.ParseIP(opts.SourceIP)
+		if sourceIP == nil {
+			fatal("Invalid --source-ip", "ip", opts.SourceIP)
+		}
+	}
 
-	// Start workers
-	wg := &sync.WaitGroup{}
-	for i := 0; i < opts.Threads; i++ {
-		wg.Add(1)
-		go doWork(work, wg, resolvers, outputFile, rateLimiter)
+	var cache *rdns.Cache
+	if opts.CacheSize > 0 || opts.CacheFile != "" {
+		cache = rdns.NewCache(opts.CacheSize, opts.CacheTTL)
+	}
+	if cache != nil && opts.CacheUseTTL {
+		if !opts.Raw {
+			fatal("--cache-use-ttl requires --raw")
+		}
+		cache.UseRecordTTL()
+	}
+	if opts.CacheFile != "" {
+		if err := cache.Load(opts.CacheFile); err != nil {
+			fatal("Failed to load cache file", "err", err)
+		}
 	}
 
-	wg.Wait()
+	var generic []*regexp.Regexp
+	if (opts.SkipGeneric || opts.ExpandNeighbors > 0) && opts.GenericFile != "" {
+		generic = loadGenericPatterns(opts.GenericFile)
+	}
 
-	if opts.Verbose {
-		progressDone <- true
-		fmt.Fprintf(os.Stderr, "\nCompleted: %d total, %d resolved, %d failed\n", 
-			atomic.LoadInt64(&stats.total), 
-			atomic.LoadInt64(&stats.resolved), 
-			atomic.LoadInt64(&stats.failed))
+	if !opts.NoFDCheck {
+		capThreadsForFDs(&opts, len(resolvers))
 	}
-}
 
-func loadResolversFromFile(filename string) []string {
-	file, err := os.Open(filename)
+	cfg := rdns.Config{
+		Resolvers:          resolvers,
+		Weights:            weights,
+		Protocol:           opts.Protocol,
+		Port:               opts.Port,
+		TLSServerName:      opts.TLSServer,
+		Timeout:            time.Duration(opts.Timeout) * time.Second,
+		Timeout6:           time.Duration(opts.Timeout6) * time.Second,
+		RetriesPerResolver: opts.RetriesPerResolver,
+		MaxResolvers:       opts.MaxResolvers,
+		RetryStrategy:      opts.RetryStrategy,
+		RaceResolvers:      opts.RaceResolvers,
+		QueryAll:           opts.QueryAll,
+		PerIPTimeout:       opts.PerIPTimeout,
+		Raw:                opts.Raw,
+		ECS:                ecs,
+		NoRecursion:        opts.NoRecursion,
+		DNSSEC:             opts.DNSSEC,
+		ExtraTypes:         extraTypes,
+		Proxy:              proxyURL,
+		SourceIP:           sourceIP,
+		Validate:           opts.Validate,
+		SkipGeneric:        opts.SkipGeneric,
+		MaxHostnames:       opts.MaxPTRRecords,
+		GenericPatterns:    generic,
+		Workers:            opts.Threads,
+		ShuffleResolvers:   opts.ShuffleResolvers,
+		Seed:               opts.Seed,
+		GroupBy24:          opts.GroupBy24,
+		EjectAfter:         opts.EjectAfter,
+		EjectCooldown:      opts.EjectCooldown,
+		RateLimit:          opts.RateLimit,
+		MaxInflight:        opts.MaxInflight,
+		ConnPoolSize:       opts.ConnPoolSize,
+		UDPSockets:         opts.UDPSockets,
+		GlobalRate:         opts.GlobalRate,
+		RateJitter:         float64(opts.RateJitter) / 100,
+		MaxQueries:         opts.MaxQueries,
+		Cache:              cache,
+		SlowQuery:          opts.LogSlow,
+	}
+	cfg.Logger = slog.Default()
+	scanner, err := rdns.NewScanner(cfg)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to open resolvers file: %v\n", err)
-		os.Exit(1)
+		fatal(err.Error())
+	}
+	if opts.ForwardFirst {
+		gen.scanner = scanner
+		gen.seen = make(map[string]bool)
 	}
-	defer file.Close()
 
-	var resolvers []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line != "" && !strings.HasPrefix(line, "#") {
-			resolvers = append(resolvers, line)
+	if opts.DryRun {
+		dryRun(gen, stdin)
+		return
+	}
+
+	if opts.BenchmarkResolvers {
+		targets := opts.BenchmarkTargets
+		if len(targets) == 0 {
+			targets = benchmarkTargets
+		}
+		for _, ip := range targets {
+			if net.ParseIP(ip) == nil {
+				fatal("Invalid --benchmark-target", "ip", ip)
+			}
 		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		printBenchmark(os.Stdout, benchmarkResolvers(ctx, scanner, resolvers, targets, opts.Threads))
+		return
 	}
 
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read resolvers file: %v\n", err)
-		os.Exit(1)
+	// Failures and everything else are written as with --json
+	if opts.JSONFlatten {
+		opts.JSON = true
+	}
+	if opts.JSON && opts.CSV {
+		fatal("--json and --csv cannot be used together")
 	}
 
-	return resolvers
-}
+	// The --format-compat presets are --format templates, see formatPresets
+	if opts.FormatCompat != "" {
+		if opts.Format != "" || opts.JSON || opts.CSV || opts.Domain || opts.ShowFailed {
+			fatal("--format-compat cannot be used with --format, --json, --csv, -d or --show-failed")
+		}
+		if opts.BinaryOutput != "" || opts.CountOnly || opts.ReportDisagree {
+			fatal("--format-compat cannot be used with --binary-output, --count-only or --report-disagreement")
+		}
+		opts.Format = formatPresets[opts.FormatCompat]
+	}
 
-func generateIPsFromFile(filename string, work chan<- string) {
-	file, err := os.Open(filename)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to open input file: %v\n", err)
-		os.Exit(1)
+	if opts.BinaryOutput != "" && (opts.JSON || opts.CSV || opts.Format != "" || opts.ShowFailed) {
+		fatal("--binary-output cannot be used with --json, --csv, --format or --show-failed")
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
+	var template []templateField
+	if opts.Format != "" {
+		if opts.JSON || opts.CSV {
+			fatal("--format cannot be used with --json or --csv")
+		}
+		var err error
+		template, err = parseTemplate(opts.Format, &opts)
+		if err != nil {
+			fatal("Invalid --format", "err", err)
 		}
-		
-		expandIPRange(line, work)
 	}
 
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read input file: %v\n", err)
-		os.Exit(1)
+	if opts.OnlyWithPTR && opts.OnlyWithoutPTR {
+		fatal("--only-with-ptr and --only-without-ptr cannot be used together")
 	}
-}
 
-func generateIPsFromStdin(work chan<- string) {
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
+	if opts.OnlyWithPTR && opts.ShowFailed {
+		fatal("--only-with-ptr and --show-failed cannot be used together")
+	}
+
+	if opts.CoverageHistogram && !opts.CountOnly {
+		fatal("--coverage-histogram needs --count-only")
+	}
+	if opts.CountOnly {
+		if opts.CSV || opts.Format != "" || opts.BinaryOutput != "" || opts.Domain || opts.ShowFailed {
+			fatal("--count-only cannot be used with --csv, --format, --binary-output, -d or --show-failed")
+		}
+		if opts.OnlyWithPTR || opts.OnlyWithoutPTR || opts.ReportDisagree {
+			fatal("--count-only cannot be used with --only-with-ptr, --only-without-ptr or --report-disagreement")
 		}
-		
-		expandIPRange(line, work)
 	}
-}
 
-func expandIPRange(input string, work chan<- string) {
-	input = strings.TrimSpace(input)
-	
-	// Check if it's a CIDR range
-	if strings.Contains(input, "/") {
-		_, ipnet, err := net.ParseCIDR(input)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Invalid CIDR range: %s\n", input)
-			return
+	if opts.DetectLying || opts.DropLying {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		lying := findLyingResolvers(ctx, scanner, resolvers, lieProbeTargets(newRand(opts.Seed)), opts.Threads)
+		stop()
+		for _, l := range lying {
+			slog.Warn("Resolver returned a PTR for an address that has none", "resolver", l.resolver, "ip", l.ip, "ptr", l.hostname, "dropped", opts.DropLying)
 		}
-		
-		// Generate all IPs in the CIDR range
-		for ip := ipnet.IP.Mask(ipnet.Mask); ipnet.Contains(ip); incrementIP(ip) {
-			atomic.AddInt64(&stats.total, 1)
-			work <- ip.String()
+
+		if opts.DropLying && len(lying) > 0 {
+			resolvers = withoutLying(resolvers, lying)
+			if len(resolvers) == 0 {
+				fatal("Every resolver returned PTRs for addresses that have none")
+			}
+			// The probes may have left pooled connections open
+			scanner.Close()
+			cfg.Resolvers = resolvers
+			if scanner, err = rdns.NewScanner(cfg); err != nil {
+				fatal(err.Error())
+			}
+			if gen.scanner != nil {
+				gen.scanner = scanner
+			}
+		}
+	}
+
+	slog.Info("Starting scan", "resolvers", len(resolvers), "threads", opts.Threads)
+
+	// Setup output
+	rotate := opts.OutputRotateLines > 0 || opts.OutputRotateSize > 0
+	if rotate && opts.Output == "" {
+		fatal("--output-rotate-lines and --output-rotate-size need --output")
+	}
+	if rotate && opts.Append {
+		fatal("--append can't be used with --output-rotate-lines or --output-rotate-size")
+	}
+	// Rotation splits at newlines, which packed addresses can contain
+	if rotate && opts.BinaryOutput != "" {
+		fatal("--binary-output can't be used with --output-rotate-lines or --output-rotate-size")
+	}
+	if opts.Tee && opts.Output == "" {
+		fatal("--tee needs --output")
+	}
+	if opts.SyslogAddr != "" && !opts.Syslog {
+		fatal("--syslog-addr needs --syslog")
+	}
+	if opts.Syslog && (opts.Output != "" || opts.BinaryOutput != "") {
+		fatal("--syslog cannot be used with --output or --binary-output")
+	}
+	var outputFile *os.File
+	if opts.Output != "" {
+		outputFile, err = createOutput(opts.Output, opts.Append)
+		if err != nil {
+			fatal("Failed to create output file", "err", err)
 		}
+		defer outputFile.Close()
 	} else {
-		// Single IP address
-		if net.ParseIP(input) != nil {
-			atomic.AddInt64(&stats.total, 1)
-			work <- input
-		} else {
-			fmt.Fprintf(os.Stderr, "Invalid IP address: %s\n", input)
+		outputFile = os.Stdout
+	}
+
+	var failedFile *os.File
+	if opts.FailedOutput != "" {
+		if opts.Output != "" && samePath(opts.Output, opts.FailedOutput) {
+			fatal("--output and --failed-output must be different files")
+		}
+
+		failedFile, err = createOutput(opts.FailedOutput, opts.Append)
+		if err != nil {
+			fatal("Failed to create failed output file", "err", err)
 		}
+		defer failedFile.Close()
 	}
-}
 
-func incrementIP(ip net.IP) {
-	for j := len(ip) - 1; j >= 0; j-- {
-		ip[j]++
-		if ip[j] > 0 {
-			break
+	var remainingFile *os.File
+	if opts.RemainingOutput != "" {
+		remainingFile, err = createOutput(opts.RemainingOutput, opts.Append)
+		if err != nil {
+			fatal("Failed to create remaining output file", "err", err)
 		}
+		defer remainingFile.Close()
 	}
-}
 
-func doWork(work <-chan string, wg *sync.WaitGroup, resolvers []string, outputFile *os.File, rateLimiter <-chan time.Time) {
-	defer wg.Done()
-
-	outputMutex := &sync.Mutex{}
-
-	for ip := range work {
-		// Apply rate limiting if configured
-		if rateLimiter != nil {
-			<-rateLimiter
-		}
-
-		resolved := false
-
-		for _, resolverIP := range resolvers {
-			for retry := 0; retry <= opts.Retries; retry++ {
-				ctx, cancel := context.WithTimeout(context.Background(), time.Duration(opts.Timeout)*time.Second)
-				
-				r := &net.Resolver{
-					PreferGo: true,
-					Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-						d := net.Dialer{
-							Timeout: time.Duration(opts.Timeout) * time.Second,
-						}
-						return d.DialContext(ctx, opts.Protocol, fmt.Sprintf("%s:%d", resolverIP, opts.Port))
-					},
-				}
-
-				addr, err := r.LookupAddr(ctx, ip)
-				cancel()
-
-				if err == nil && len(addr) > 0 {
-					outputMutex.Lock()
-					for _, a := range addr {
-						if opts.Domain {
-							fmt.Fprintln(outputFile, strings.TrimRight(a, "."))
-						} else {
-							fmt.Fprintf(outputFile, "%s\t%s\n", ip, strings.TrimRight(a, "."))
-						}
-					}
-					outputMutex.Unlock()
-					
-					resolved = true
-					atomic.AddInt64(&stats.resolved, 1)
-					break
-				}
-				
-				// Small delay between retries
-				if retry < opts.Retries {
-					time.Sleep(100 * time.Millisecond)
-				}
-			}
-			
-			if resolved {
-				break
-			}
+	var output io.Writer = outputFile
+	if opts.Syslog {
+		conn, err := dialSyslog(opts.SyslogAddr, opts.SyslogPriority)
+		if err != nil {
+			fatal("Failed to connect to syslog", "err", err)
 		}
+		sink := &syslogOutput{w: conn}
+		defer sink.Close()
+		output = sink
+	}
+	if rotate {
+		rotating := newRotatingOutput(outputFile, opts.Output, opts.OutputRotateLines, opts.OutputRotateSize)
+		defer rotating.Close()
+		output = rotating
+	}
 
-		if !resolved {
-			atomic.AddInt64(&stats.failed, 1)
-			if opts.ShowFailed {
-				outputMutex.Lock()
-				fmt.Fprintf(outputFile, "%s\tFAILED\n", ip)
-				outputMutex.Unlock()
-			}
+	// A single writer goroutine does all output so workers never contend
+	// on a lock. Creating it writes any header before workers start.
+	var failed, remaining io.Writer
+	if failedFile != nil {
+		failed = failedFile
+	}
+	if remainingFile != nil {
+		remaining = remainingFile
+	}
+	writer := newResultWriter(&opts, stats, template, asnDB, output, failed, remaining)
+	results := make(chan rdns.Result, opts.Threads)
+	if remainingFile != nil {
+		gen.leftovers = results
+	}
+	gen.failures = results
+	writerDone := make(chan struct{})
+	go writer.run(results, writerDone)
+
+	// Cancel the run on Ctrl-C, aborting in-flight lookups so the partial
+	// results are kept. A second Ctrl-C exits immediately.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		signal.Stop(sigs)
+		slog.Warn("Interrupted, cancelling in-flight lookups")
+		cancel()
+	}()
+
+	// Stop the same way once --max-duration has passed or --max-queries
+	// has been used up
+	limitReached := int32(0)
+	if opts.MaxDuration > 0 {
+		timer := time.AfterFunc(opts.MaxDuration, func() {
+			atomic.StoreInt32(&limitReached, 1)
+			slog.Warn("Maximum duration reached, cancelling in-flight lookups")
+			cancel()
+		})
+		defer timer.Stop()
+	}
+	go func() {
+		select {
+		case <-scanner.QueryCapReached():
+			atomic.StoreInt32(&limitReached, 1)
+			slog.Warn("Maximum queries reached, cancelling in-flight lookups")
+			cancel()
+		case <-ctx.Done():
 		}
+	}()
 
-		atomic.AddInt64(&stats.processed, 1)
+	// Create work channel with buffer. With --expand-neighbors the input
+	// goes through the expander, which closes work once it is done.
+	work := make(chan rdns.Target, opts.Threads*2)
+	input := work
+	var expander *neighborExpander
+	if opts.ExpandNeighbors > 0 {
+		expander = newNeighborExpander(scanner, gen, stats, opts.ExpandNeighbors, opts.MaxNeighbors)
+		input = make(chan rdns.Target, opts.Threads*2)
 	}
-}
 
-func showProgress(done <-chan bool) {
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+	// Start progress reporter if verbose
+	var progressStop, progressDone chan struct{}
+	if opts.Verbose {
+		progressStop = make(chan struct{})
+		progressDone = make(chan struct{})
+		go showProgress(progressStop, progressDone, opts.ProgressInterval, stats, scanner, work)
+	}
 
 	startTime := time.Now()
 
-	for {
-		select {
-		case <-done:
-			return
-		case <-ticker.C:
-			processed := atomic.LoadInt64(&stats.processed)
-			resolved := atomic.LoadInt64(&stats.resolved)
-			total := atomic.LoadInt64(&stats.total)
-			
-			elapsed := time.Since(startTime)
-			rate := float64(processed) / elapsed.Seconds()
-			
-			fmt.Fprintf(os.Stderr, "Progress: %d/%d processed, %d resolved, %.1f IPs/sec\n", 
-				processed, total, resolved, rate)
+	// Start metrics server if requested
+	var metricsServer *http.Server
+	if opts.MetricsAddr != "" {
+		metricsServer = startMetricsServer(opts.MetricsAddr, startTime, stats, scanner)
+	}
+
+	// Start IP generator
+	genDone := make(chan struct{})
+	go func() {
+		defer close(genDone)
+		defer close(input)
+		defer atomic.StoreInt32(&stats.inputDone, 1)
+		
+		if len(opts.ListFiles) > 0 {
+			gen.fromFiles(ctx, opts.ListFiles, input)
+		} else {
+			gen.fromStdin(ctx, stdin, input)
+		}
+	}()
+
+	// With --retry-failed-passes, failures go through a retrier that
+	// holds back those worth another try
+	var retrier *failureRetrier
+	retrierResults := results
+	var held chan []rdns.Result
+	if opts.RetryPasses > 0 {
+		retrier = &failureRetrier{scanner: scanner, stats: stats, results: results}
+		retrierResults = make(chan rdns.Result, opts.Threads)
+		held = make(chan []rdns.Result)
+		go func() {
+			failures, _ := retrier.collect(retrierResults, nil)
+			held <- failures
+		}()
+	}
+
+	// With --expand-neighbors, results pass through the expander before
+	// the retrier
+	runResults := retrierResults
+	var expanderDone chan struct{}
+	if expander != nil {
+		runResults = make(chan rdns.Result, opts.Threads)
+		expanderDone = make(chan struct{})
+		go func() {
+			defer close(expanderDone)
+			expander.run(ctx, input, work, runResults, retrierResults)
+		}()
+	}
+
+	scanner.Run(ctx, work, runResults)
+
+	// Anything still queued when the run stopped was never looked up.
+	// Ranging over work also waits for the generator to finish sending.
+	if remainingFile != nil {
+		for target := range work {
+			results <- rdns.Result{IP: target.IP, Skipped: true, Comment: target.Comment}
+		}
+	}
+
+	// The generator may still be reporting hostnames that failed
+	<-genDone
+	if expander != nil {
+		close(runResults)
+		<-expanderDone
+	}
+	if retrier != nil {
+		close(retrierResults)
+		retrier.retry(ctx, <-held, opts.RetryPasses)
+	}
+	close(results)
+	<-writerDone
+	if opts.CacheFile != "" {
+		if err := cache.Save(opts.CacheFile); err != nil {
+			slog.Error("Failed to save cache", "err", err)
+		}
+	}
+
+	stopped := ctx.Err() != nil
+	interrupted := stopped && atomic.LoadInt32(&limitReached) == 0
+	stopMetricsServer(metricsServer)
+	if opts.Verbose {
+		// Wait for any progress bar to be cleared before the summary
+		close(progressStop)
+		<-progressDone
+	}
+	if opts.Verbose || (stopped && !opts.Quiet) {
+		printSummary(&opts, stats, scanner, resolvers)
+	}
+	if opts.SummaryJSON != "" {
+		writeSummaryJSON(opts.SummaryJSON, &opts, stats, scanner, resolvers, time.Since(startTime), stopped)
+	}
+	if opts.ResolverStatsFile != "" {
+		if err := writeResolverStats(opts.ResolverStatsFile, scanner); err != nil {
+			slog.Error("Failed to write resolver stats", "err", err)
 		}
 	}
+
+	code := exitInterrupted
+	if !interrupted {
+		code = exitStatus(&opts, stats, scanner.Stats())
+	}
+	if code != 0 {
+		outputFile.Close()
+		if failedFile != nil {
+			failedFile.Close()
+		}
+		os.Exit(code)
+	}
+}
+
+// Exit statuses of a run, besides 0 and 1 for errors that stop it
+// before it starts.
+const (
+	exitLookupsFailed = 2
+	exitNoInput       = 3
+	exitNoResolvers   = 4
+	exitInterrupted   = 130
+)
+
+// exitStatus picks the exit status of a run that wasn't interrupted,
+// according to --fail-on.
+func exitStatus(opts *options, stats *Stats, counts rdns.Stats) int {
+	if opts.FailOn == "none" {
+		return 0
+	}
+
+	if atomic.LoadInt64(&stats.total) == 0 {
+		slog.Warn("No IPs to look up in the input")
+		return exitNoInput
+	}
+	// An NXDOMAIN is a real answer, so at least one resolver works
+	if counts.Resolved == 0 && counts.NXDomain == 0 && counts.Failed > 0 {
+		slog.Warn("No resolver gave a usable answer")
+		return exitNoResolvers
+	}
+
+	failed := counts.Failed + atomic.LoadInt64(&stats.unresolved)
+	switch {
+	case opts.FailOn == "all-failure" && counts.Resolved == 0:
+		slog.Warn("No IPs resolved")
+		return exitLookupsFailed
+	case opts.FailOn == "any-failure" && failed > 0:
+		slog.Warn("Some lookups failed", "failed", failed)
+		return exitLookupsFailed
+	}
+	return 0
+}
+
+// dryRun prints every IP the input expands to, one per line, then the
+// count on stderr. No resolvers are needed and nothing is queried.
+func dryRun(gen *generator, stdin io.Reader) {
+	work := make(chan rdns.Target, 1024)
+	go func() {
+		defer close(work)
+		if len(gen.opts.ListFiles) > 0 {
+			gen.fromFiles(context.Background(), gen.opts.ListFiles, work)
+		} else {
+			gen.fromStdin(context.Background(), stdin, work)
+		}
+	}()
+
+	out := bufio.NewWriter(os.Stdout)
+	for target := range work {
+		fmt.Fprintln(out, target.IP)
+	}
+	out.Flush()
+
+	if gen.opts.Quiet {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%d IPs would be queried", atomic.LoadInt64(&gen.stats.total))
+	if excluded := atomic.LoadInt64(&gen.stats.excluded); excluded > 0 {
+		fmt.Fprintf(os.Stderr, ", %d excluded", excluded)
+	}
+	if private := atomic.LoadInt64(&gen.stats.private); private > 0 {
+		fmt.Fprintf(os.Stderr, ", %d private skipped", private)
+	}
+	if otherFamily := atomic.LoadInt64(&gen.stats.otherFamily); otherFamily > 0 {
+		fmt.Fprintf(os.Stderr, ", %d of the other address family skipped", otherFamily)
+	}
+	if invalid := atomic.LoadInt64(&gen.stats.invalid); invalid > 0 {
+		fmt.Fprintf(os.Stderr, ", %d invalid lines", invalid)
+	}
+	fmt.Fprintln(os.Stderr)
+}
+
+// newRand returns a random source seeded from seed, or from the clock
+// when seed is 0.
+func newRand(seed int64) *rand.Rand {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed))
+}
+
+// runSummary is the --summary-json report.
+type runSummary struct {
+	Total             int64             `json:"total"`
+	Resolved          int64             `json:"resolved"`
+	Failed            int64             `json:"failed"`
+	Processed         int64             `json:"processed"`
+	Validated         int64             `json:"validated"`
+	Unvalidated       int64             `json:"unvalidated"`
+	Generic           int64             `json:"generic"`
+	Excluded          int64             `json:"excluded"`
+	Private           int64             `json:"private"`
+	OtherFamily       int64             `json:"other_family"`
+	Invalid           int64             `json:"invalid"`
+	DomainNotIncluded int64             `json:"domain_not_included"`
+	DomainExcluded    int64             `json:"domain_excluded"`
+	Neighbors         int64             `json:"neighbors"`
+	Recovered         int64             `json:"recovered"`
+	Disagreements     int64             `json:"disagreements"`
+	UnresolvedHosts   int64             `json:"unresolved_hosts"`
+	Cached            int64             `json:"cached"`
+	Truncated         int64             `json:"truncated"`
+	DroppedPTR        int64             `json:"dropped_ptr"`
+	Queries           int64             `json:"queries"`
+	AvgAttempts       float64           `json:"avg_attempts"`
+	NXDomain          int64             `json:"nxdomain"`
+	ServFail          int64             `json:"servfail"`
+	Timeout           int64             `json:"timeout"`
+	OtherErrors       int64             `json:"other_errors"`
+	ElapsedSeconds    float64           `json:"elapsed_seconds"`
+	Rate              float64           `json:"ips_per_second"`
+	Resolvers         int               `json:"resolvers"`
+	Threads           int               `json:"threads"`
+	Interrupted       bool              `json:"interrupted"`
+	ResolverQueries   map[string]int64  `json:"resolver_queries"`
+	ResolverStats     []resolverSummary `json:"resolver_stats"`
+}
+
+// resolverSummary is one resolver's entry in the JSON summary.
+type resolverSummary struct {
+	Resolver  string `json:"resolver"`
+	Queries   int64  `json:"queries"`
+	Succeeded int64  `json:"succeeded"`
+	Timeouts  int64  `json:"timeouts"`
+}
+
+// writeSummaryJSON writes the run statistics as a single JSON object to
+// stderr when dest is "-", otherwise to the file dest.
+func writeSummaryJSON(dest string, opts *options, stats *Stats, scanner *rdns.Scanner, resolvers []string, elapsed time.Duration, interrupted bool) {
+	counts := scanner.Stats()
+	summary := runSummary{
+		Total:             atomic.LoadInt64(&stats.total),
+		Resolved:          counts.Resolved,
+		Failed:            counts.Failed,
+		Processed:         counts.Processed,
+		Validated:         counts.Validated,
+		Unvalidated:       counts.Unvalidated,
+		Generic:           counts.Generic,
+		Excluded:          atomic.LoadInt64(&stats.excluded),
+		Private:           atomic.LoadInt64(&stats.private),
+		OtherFamily:       atomic.LoadInt64(&stats.otherFamily),
+		Invalid:           atomic.LoadInt64(&stats.invalid),
+		DomainNotIncluded: atomic.LoadInt64(&stats.domainNotIncluded),
+		DomainExcluded:    atomic.LoadInt64(&stats.domainExcluded),
+		Neighbors:         atomic.LoadInt64(&stats.neighbors),
+		Recovered:         atomic.LoadInt64(&stats.recovered),
+		Disagreements:     counts.Disagreements,
+		UnresolvedHosts:   atomic.LoadInt64(&stats.unresolved),
+		Cached:            counts.Cached,
+		Truncated:         counts.Truncated,
+		DroppedPTR:        counts.Dropped,
+		Queries:           counts.Queries,
+		NXDomain:          counts.NXDomain,
+		ServFail:          counts.ServFail,
+		Timeout:           counts.Timeout,
+		OtherErrors:       counts.OtherErrors,
+		ElapsedSeconds:    elapsed.Seconds(),
+		Resolvers:         len(resolvers),
+		Threads:           opts.Threads,
+		Interrupted:       interrupted,
+		ResolverQueries:   make(map[string]int64, len(resolvers)),
+	}
+	if elapsed > 0 {
+		summary.Rate = float64(summary.Processed) / elapsed.Seconds()
+	}
+	summary.AvgAttempts = averageAttempts(counts)
+	queries := scanner.ResolverQueries()
+	for i, resolverIP := range resolvers {
+		summary.ResolverQueries[resolverIP] += queries[i]
+	}
+	for _, r := range sortedResolverStats(scanner) {
+		summary.ResolverStats = append(summary.ResolverStats, resolverSummary{
+			Resolver:  r.Resolver,
+			Queries:   r.Queries,
+			Succeeded: r.Succeeded,
+			Timeouts:  r.Timeouts,
+		})
+	}
+
+	line, err := json.Marshal(summary)
+	if err != nil {
+		slog.Error("Failed to encode summary", "err", err)
+		return
+	}
+	line = append(line, '\n')
+
+	if dest == "-" {
+		os.Stderr.Write(line)
+		return
+	}
+	if err := os.WriteFile(dest, line, 0644); err != nil {
+		slog.Error("Failed to write summary", "err", err)
+	}
+}
+
+func printSummary(opts *options, stats *Stats, scanner *rdns.Scanner, resolvers []string) {
+	counts := scanner.Stats()
+	fmt.Fprintf(os.Stderr, "\nCompleted: %d total, %d resolved, %d failed\n", 
+		atomic.LoadInt64(&stats.total), 
+		counts.Resolved, 
+		counts.Failed)
+	fmt.Fprintf(os.Stderr, "Failures: %d nxdomain, %d servfail, %d timeout, %d other\n",
+		counts.NXDomain,
+		counts.ServFail,
+		counts.Timeout,
+		counts.OtherErrors)
+	if opts.ExcludeFile != "" {
+		fmt.Fprintf(os.Stderr, "Excluded: %d\n", atomic.LoadInt64(&stats.excluded))
+	}
+	if opts.SkipPrivate {
+		fmt.Fprintf(os.Stderr, "Private and reserved skipped: %d\n", atomic.LoadInt64(&stats.private))
+	}
+	if opts.OnlyIPv4 || opts.OnlyIPv6 {
+		fmt.Fprintf(os.Stderr, "Other address family skipped: %d\n", atomic.LoadInt64(&stats.otherFamily))
+	}
+	if opts.ForwardFirst {
+		fmt.Fprintf(os.Stderr, "Hostnames not resolved: %d\n", atomic.LoadInt64(&stats.unresolved))
+	}
+	if invalid := atomic.LoadInt64(&stats.invalid); invalid > 0 {
+		fmt.Fprintf(os.Stderr, "Invalid input lines: %d\n", invalid)
+	}
+	if len(opts.IncludeDomains) > 0 {
+		fmt.Fprintf(os.Stderr, "Hostnames outside included domains: %d\n", atomic.LoadInt64(&stats.domainNotIncluded))
+	}
+	if len(opts.ExcludeDomains) > 0 {
+		fmt.Fprintf(os.Stderr, "Hostnames in excluded domains: %d\n", atomic.LoadInt64(&stats.domainExcluded))
+	}
+	if opts.ExpandNeighbors > 0 {
+		fmt.Fprintf(os.Stderr, "Neighbors queued: %d\n", atomic.LoadInt64(&stats.neighbors))
+	}
+	if opts.RetryPasses > 0 {
+		fmt.Fprintf(os.Stderr, "Recovered by retry passes: %d\n", atomic.LoadInt64(&stats.recovered))
+	}
+	fmt.Fprintf(os.Stderr, "Queries sent: %d (%.2f per IP)\n", counts.Queries, averageAttempts(counts))
+	if opts.QueryAll {
+		fmt.Fprintf(os.Stderr, "Resolvers disagreed on: %d\n", counts.Disagreements)
+	}
+	if opts.CacheSize > 0 || opts.CacheFile != "" {
+		fmt.Fprintf(os.Stderr, "Answered from cache: %d\n", counts.Cached)
+	}
+	if opts.Raw && opts.Protocol == "udp" {
+		fmt.Fprintf(os.Stderr, "Truncated, retried over TCP: %d\n", counts.Truncated)
+	}
+	if opts.SkipGeneric {
+		fmt.Fprintf(os.Stderr, "Generic hostnames suppressed: %d\n", counts.Generic)
+	}
+	if opts.MaxPTRRecords > 0 {
+		fmt.Fprintf(os.Stderr, "Hostnames over --max-ptr-records: %d\n", counts.Dropped)
+	}
+	if opts.Validate {
+		fmt.Fprintf(os.Stderr, "Forward-confirmed: %d verified, %d unverified\n",
+			counts.Validated,
+			counts.Unvalidated)
+	}
+	for _, r := range sortedResolverStats(scanner) {
+		fmt.Fprintf(os.Stderr, "  %s: %d queries, %d succeeded (%.1f%%), %d timed out\n",
+			r.Resolver, r.Queries, r.Succeeded, successRate(r), r.Timeouts)
+	}
+}
+
+// sortedResolverStats returns the lookups sent to each resolver, best
+// success rate first and busiest first among equals.
+func sortedResolverStats(scanner *rdns.Scanner) []rdns.ResolverStats {
+	stats := scanner.ResolverStats()
+	sort.SliceStable(stats, func(a, b int) bool {
+		if rateA, rateB := successRate(stats[a]), successRate(stats[b]); rateA != rateB {
+			return rateA > rateB
+		}
+		return stats[a].Queries > stats[b].Queries
+	})
+	return stats
+}
+
+// successRate is the percentage of r's queries that succeeded, or 0 if it
+// wasn't sent any.
+func successRate(r rdns.ResolverStats) float64 {
+	if r.Queries == 0 {
+		return 0
+	}
+	return 100 * float64(r.Succeeded) / float64(r.Queries)
+}
+
+// writeResolverStats writes the lookups sent to each resolver to path as
+// CSV, in the same order as the summary.
+func writeResolverStats(path string, scanner *rdns.Scanner) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(file)
+	w.Write([]string{"resolver", "queries", "succeeded", "timeouts", "success_rate"})
+	for _, r := range sortedResolverStats(scanner) {
+		w.Write([]string{
+			r.Resolver,
+			strconv.FormatInt(r.Queries, 10),
+			strconv.FormatInt(r.Succeeded, 10),
+			strconv.FormatInt(r.Timeouts, 10),
+			strconv.FormatFloat(successRate(r), 'f', 1, 64),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// averageAttempts is the mean number of queries sent for each IP that was
+// looked up, leaving out those answered from the cache.
+func averageAttempts(counts rdns.Stats) float64 {
+	queried := counts.Processed - counts.Cached
+	if queried <= 0 {
+		return 0
+	}
+	return float64(counts.Queries) / float64(queried)
+}
+
+func loadResolversFromFile(filename string, opts *options) []string {
+	file, err := os.Open(filename)
+	if err != nil {
+		fatal("Failed to open resolvers file", "err", err)
+	}
+	defer file.Close()
+
+	reader, err := decompress(file)
+	if err != nil {
+		fatal("Failed to read resolvers file", "err", err)
+	}
+
+	var entries []string
+	scanner := newLineScanner(reader, opts.MaxLineLength)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+
+	if err := scanErr(scanner, opts.MaxLineLength); err != nil {
+		fatal("Failed to read resolvers file", "err", err)
+	}
+
+	return parseResolverEntries(entries, opts)
+}
+
+// systemResolvConf is where --use-system finds the system's resolvers.
+const systemResolvConf = "/etc/resolv.conf"
+
+// loadSystemResolvers returns the nameservers from /etc/resolv.conf for
+// --use-system, skipping any that aren't valid resolvers.
+func loadSystemResolvers(opts *options) []string {
+	if runtime.GOOS == "windows" {
+		fatal("--use-system isn't supported on Windows, give the resolvers with -r or -R")
+	}
+
+	conf, err := dns.ClientConfigFromFile(systemResolvConf)
+	if err != nil {
+		fatal("Failed to read system resolvers", "err", err)
+	}
+	resolvers := parseResolverEntries(conf.Servers, opts)
+	if len(resolvers) == 0 {
+		fatal("No valid resolvers", "file", systemResolvConf)
+	}
+	return resolvers
+}
+
+// parseResolverEntries validates each resolver entry, skipping invalid
+// ones with a warning. An entry may be followed by "weight=N", and is
+// then listed N times, which weighResolvers turns back into a weight.
+func parseResolverEntries(entries []string, opts *options) []string {
+	var resolvers []string
+	for _, entry := range entries {
+		fields := strings.Fields(entry)
+		weight, err := parseResolverWeight(fields[1:])
+		if err != nil {
+			slog.Warn("Skipping resolver", "resolver", entry, "err", err)
+			continue
+		}
+		resolver, err := parseResolverEntry(fields[0], opts)
+		if err != nil {
+			slog.Warn("Skipping resolver", "resolver", entry, "err", err)
+			continue
+		}
+		for i := 0; i < weight; i++ {
+			resolvers = append(resolvers, resolver)
+		}
+	}
+	return resolvers
+}
+
+// maxResolverWeight bounds the weight=N of a resolver entry.
+const maxResolverWeight = 1000
+
+// parseResolverWeight reads the "weight=N" option that may follow a
+// resolver, returning 1 if there isn't one.
+func parseResolverWeight(options []string) (int, error) {
+	weight := 1
+	for _, option := range options {
+		value, ok := strings.CutPrefix(option, "weight=")
+		if !ok {
+			return 0, fmt.Errorf("unknown option %q", option)
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxResolverWeight {
+			return 0, fmt.Errorf("weight must be between 1 and %d", maxResolverWeight)
+		}
+		weight = n
+	}
+	return weight, nil
+}
+
+// weighResolvers folds repeated resolvers into one entry each, in the
+// order they first appear, with the number of times each was listed as
+// its weight. weights is nil if no resolver was repeated.
+func weighResolvers(listed []string) (resolvers []string, weights map[string]int) {
+	counts := make(map[string]int, len(listed))
+	for _, resolver := range listed {
+		if counts[resolver] == 0 {
+			resolvers = append(resolvers, resolver)
+		}
+		counts[resolver]++
+	}
+	if len(resolvers) == len(listed) {
+		return resolvers, nil
+	}
+	return resolvers, counts
+}
+
+// readStdinHeader reads resolvers from the lines of stdin before a "---"
+// delimiter, and returns them with a reader for the targets that follow.
+// Without a delimiter every line is a target, so the input has to be held
+// in memory until its end to find that out.
+func readStdinHeader(stdin io.Reader, opts *options) ([]string, io.Reader) {
+	reader, err := decompress(stdin)
+	if err != nil {
+		fatal("Failed to read input", "err", err)
+	}
+	br := bufio.NewReader(reader)
+
+	var header bytes.Buffer
+	var entries []string
+	for {
+		line, err := br.ReadString('\n')
+		header.WriteString(line)
+
+		entry := strings.TrimSpace(line)
+		if entry == "---" {
+			return parseResolverEntries(entries, opts), br
+		}
+		if entry != "" && !strings.HasPrefix(entry, "#") {
+			entries = append(entries, entry)
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fatal("Failed to read input", "err", err)
+		}
+	}
+
+	slog.Warn("No --- delimiter on stdin, treating every line as a target")
+	return nil, &header
+}
+
+// loadExcludes parses a file of IPs and CIDR ranges to leave out of the
+// scan. Single IPs are treated as host routes.
+func loadExcludes(filename string, maxLineLength int) []*net.IPNet {
+	file, err := os.Open(filename)
+	if err != nil {
+		fatal("Failed to open exclude file", "err", err)
+	}
+	defer file.Close()
+
+	reader, err := decompress(file)
+	if err != nil {
+		fatal("Failed to read exclude file", "err", err)
+	}
+
+	var nets []*net.IPNet
+	scanner := newLineScanner(reader, maxLineLength)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if !strings.Contains(line, "/") {
+			if ip := net.ParseIP(line); ip != nil && ip.To4() != nil {
+				line += "/32"
+			} else {
+				line += "/128"
+			}
+		}
+
+		_, ipnet, err := net.ParseCIDR(line)
+		if err != nil {
+			slog.Warn("Invalid exclude range", "range", line)
+			continue
+		}
+		nets = append(nets, ipnet)
+	}
+
+	if err := scanErr(scanner, maxLineLength); err != nil {
+		fatal("Failed to read exclude file", "err", err)
+	}
+
+	return nets
+}
+
+// fromFiles queues the targets listed in each of filenames in turn. A
+// file that doesn't exist is skipped with a warning under --skip-missing.
+func (g *generator) fromFiles(ctx context.Context, filenames []string, work chan<- rdns.Target) {
+	groups := g.newGroups()
+	for _, filename := range filenames {
+		file, err := os.Open(filename)
+		if err != nil && g.opts.SkipMissing && os.IsNotExist(err) {
+			slog.Warn("Skipping missing input file", "file", filename)
+			continue
+		}
+		if err != nil {
+			fatal("Failed to open input file", "err", err)
+		}
+
+		queued, err := g.queueInput(ctx, file, groups, work)
+		file.Close()
+		if err != nil {
+			fatal("Failed to read input file", "file", filename, "err", err)
+		}
+		if !queued {
+			return
+		}
+	}
+
+	if groups != nil {
+		groups.flush(ctx, g, work)
+	}
+	g.flushShuffled(ctx, work)
+}
+
+// fromStdin queues the targets read from stdin.
+func (g *generator) fromStdin(ctx context.Context, stdin io.Reader, work chan<- rdns.Target) {
+	groups := g.newGroups()
+	queued, err := g.queueInput(ctx, stdin, groups, work)
+	if err != nil {
+		fatal("Failed to read input", "err", err)
+	}
+
+	if queued && groups != nil {
+		groups.flush(ctx, g, work)
+	}
+	if queued {
+		g.flushShuffled(ctx, work)
+	}
+}
+
+// newGroups returns the holding area for --group-by-24, or nil when
+// targets are queued as they are read.
+func (g *generator) newGroups() *blockGroups {
+	if g.opts.GroupBy24 {
+		return newBlockGroups()
+	}
+	return nil
+}
+
+// queueInput queues the targets read from r, which may be compressed
+// unless it is --binary-input. It returns false once ctx is cancelled.
+func (g *generator) queueInput(ctx context.Context, r io.Reader, groups *blockGroups, work chan<- rdns.Target) (bool, error) {
+	if g.opts.BinaryInput != "" {
+		return g.queueBinary(ctx, r, groups, work)
+	}
+
+	reader, err := decompress(r)
+	if err != nil {
+		return false, err
+	}
+	return g.queueLines(ctx, reader, groups, work)
+}
+
+// queueBinary queues the addresses read from r for --binary-input, packed
+// one after another with nothing in between: 4 bytes each, or 16 for
+// --binary-input=ipv6, where IPv4-mapped addresses count as IPv4. It
+// returns false once ctx is cancelled.
+func (g *generator) queueBinary(ctx context.Context, r io.Reader, groups *blockGroups, work chan<- rdns.Target) (bool, error) {
+	size := net.IPv4len
+	if g.opts.BinaryInput == "ipv6" {
+		size = net.IPv6len
+	}
+
+	reader := bufio.NewReaderSize(r, 1<<16)
+	record := make([]byte, size)
+	for {
+		n, err := io.ReadFull(reader, record)
+		switch {
+		case err == io.EOF:
+			return true, nil
+		case err == io.ErrUnexpectedEOF:
+			return true, fmt.Errorf("input ends with %d bytes, not a whole %d-byte address", n, size)
+		case err != nil:
+			return true, err
+		}
+
+		ip := make(net.IP, size)
+		copy(ip, record)
+		if groups != nil && groups.addIP(ip, "") {
+			if !groups.flushDue(ctx, g, work) {
+				return false, nil
+			}
+			continue
+		}
+		if !g.queueIP(ctx, work, ip, "") {
+			return false, nil
+		}
+	}
+}
+
+// queueLines queues the targets on each line read from r, holding single
+// IPs in groups when it isn't nil. It returns false once ctx is cancelled.
+func (g *generator) queueLines(ctx context.Context, r io.Reader, groups *blockGroups, work chan<- rdns.Target) (bool, error) {
+	scanner := newLineScanner(r, g.opts.MaxLineLength)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Every address a line expands to gets its comment
+		var comment string
+		if g.opts.Comments {
+			line, comment = splitComment(line)
+		}
+
+		if groups != nil && groups.add(line, comment) {
+			if !groups.flushDue(ctx, g, work) {
+				return false, nil
+			}
+			continue
+		}
+
+		if !g.expandIPRange(ctx, line, comment, work) {
+			return false, nil
+		}
+	}
+
+	return true, scanErr(scanner, g.opts.MaxLineLength)
+}
+
+// splitComment splits an input line such as "1.2.3.4 # known bad" into
+// the target and the comment after the #, both trimmed.
+func splitComment(line string) (string, string) {
+	target, comment, found := strings.Cut(line, "#")
+	if !found {
+		return line, ""
+	}
+	return strings.TrimSpace(target), strings.TrimSpace(comment)
+}
+
+// newLineScanner returns a line scanner over r that accepts lines up to
+// maxLength bytes instead of bufio's 64KB default.
+func newLineScanner(r io.Reader, maxLength int) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	initial := bufio.MaxScanTokenSize
+	if maxLength < initial {
+		initial = maxLength
+	}
+	scanner.Buffer(make([]byte, 0, initial), maxLength)
+	return scanner
+}
+
+// scanErr returns the error that stopped scanner, explaining how to get
+// past lines that are too long.
+func scanErr(scanner *bufio.Scanner, maxLength int) error {
+	err := scanner.Err()
+	if errors.Is(err, bufio.ErrTooLong) {
+		return fmt.Errorf("line longer than %d bytes, raise --max-line-length", maxLength)
+	}
+	return err
+}
+
+// decompress wraps r in a gzip or bzip2 reader when its first bytes carry
+// the matching magic number, and otherwise returns it unchanged.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(3)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return bzip2.NewReader(br), nil
+	default:
+		return br, nil
+	}
+}
+
+// expandIPRange queues every address described by input, along with
+// comment. It returns false once ctx is cancelled so the caller can stop
+// reading input.
+func (g *generator) expandIPRange(ctx context.Context, input, comment string, work chan<- rdns.Target) bool {
+	input = strings.TrimSpace(input)
+
+	if isArpa(input) {
+		ip := parseArpa(input)
+		if ip == nil {
+			slog.Warn("Invalid reverse DNS name", "input", input)
+			atomic.AddInt64(&g.stats.invalid, 1)
+			return true
+		}
+		return g.queueIP(ctx, work, ip, comment)
+	}
+
+	if g.scanner != nil && isHostname(input) {
+		return g.queueHost(ctx, input, comment, work)
+	}
+	
+	// Check if it's a CIDR range
+	if strings.Contains(input, "/") {
+		_, ipnet, err := net.ParseCIDR(input)
+		if err != nil {
+			slog.Warn("Invalid CIDR range", "input", input)
+			atomic.AddInt64(&g.stats.invalid, 1)
+			return true
+		}
+		
+		ip := ipnet.IP.Mask(ipnet.Mask)
+		ones, bits := ipnet.Mask.Size()
+		if !g.allowExpand(input, new(big.Int).Lsh(big.NewInt(1), uint(bits-ones)), ip.To4() == nil) {
+			return true
+		}
+
+		// Generate all IPs in the CIDR range, capping IPv6 ranges which
+		// would otherwise take forever to enumerate
+		limit := uint64(0)
+		if ip.To4() == nil && g.opts.MaxHosts > 0 {
+			if hostBits := bits - ones; hostBits >= 64 || uint64(1)<<hostBits > uint64(g.opts.MaxHosts) {
+				slog.Warn("Range exceeds --max-hosts, only the first addresses will be queried", "input", input, "max_hosts", g.opts.MaxHosts)
+				limit = uint64(g.opts.MaxHosts)
+			}
+		}
+
+		for count := uint64(0); ipnet.Contains(ip); count++ {
+			if limit > 0 && count >= limit {
+				break
+			}
+			if !g.queueIP(ctx, work, ip, comment) {
+				return false
+			}
+			if incrementIP(ip) {
+				break
+			}
+		}
+	} else if strings.Contains(input, "-") {
+		return g.expandHyphenRange(ctx, input, comment, work)
+	} else {
+		// Single IP address
+		ip := net.ParseIP(input)
+		if ip == nil {
+			slog.Warn("Invalid IP address", "input", input)
+			atomic.AddInt64(&g.stats.invalid, 1)
+			return true
+		}
+		return g.queueIP(ctx, work, ip, comment)
+	}
+
+	return true
+}
+
+// queueIP hands ip to the workers and counts it towards the total, unless
+// it is of the address family left out by --only-ipv4 or --only-ipv6,
+// falls in an excluded range or is skipped by --skip-private. Under
+// --shuffle-input, a random held IP is queued in its place. It returns
+// false without queueing if ctx is cancelled first.
+func (g *generator) queueIP(ctx context.Context, work chan<- rdns.Target, ip net.IP, comment string) bool {
+	if counter := g.skipCounter(ip); counter != nil {
+		atomic.AddInt64(counter, 1)
+		return true
+	}
+
+	if g.sampler != nil && g.sampler.Float64() >= g.opts.SampleRate {
+		return true
+	}
+
+	target := rdns.Target{IP: ip.String(), Comment: comment}
+	if g.shuffler != nil {
+		var ok bool
+		if target, ok = g.shuffler.add(target); !ok {
+			return true
+		}
+	}
+	return g.send(ctx, work, target)
+}
+
+// skipCounter returns the Stats counter for the reason ip is left out of
+// the input, or nil if it isn't. It only reads the generator's settings,
+// so it is safe to call from other goroutines.
+func (g *generator) skipCounter(ip net.IP) *int64 {
+	if isV4 := ip.To4() != nil; (g.opts.OnlyIPv4 && !isV4) || (g.opts.OnlyIPv6 && isV4) {
+		return &g.stats.otherFamily
+	}
+	for _, ipnet := range g.excludes {
+		if ipnet.Contains(ip) {
+			return &g.stats.excluded
+		}
+	}
+	if g.opts.SkipPrivate && isPrivate(ip) {
+		return &g.stats.private
+	}
+	return nil
+}
+
+// send hands target to the workers and counts it towards the total. It
+// returns false without queueing if ctx is cancelled first.
+func (g *generator) send(ctx context.Context, work chan<- rdns.Target, target rdns.Target) bool {
+	select {
+	case work <- target:
+		atomic.AddInt64(&g.stats.total, 1)
+		return true
+	case <-ctx.Done():
+		// Keep reading so every unqueued IP reaches --remaining-output
+		if g.leftovers != nil {
+			g.leftovers <- rdns.Result{IP: target.IP, Skipped: true, Comment: target.Comment}
+			return true
+		}
+		return false
+	}
+}
+
+// flushShuffled queues the IPs still held for --shuffle-input once the
+// input has all been read.
+func (g *generator) flushShuffled(ctx context.Context, work chan<- rdns.Target) {
+	if g.shuffler == nil {
+		return
+	}
+	for _, target := range g.shuffler.drain() {
+		if !g.send(ctx, work, target) {
+			return
+		}
+	}
+}
+
+// isHostname reports whether input is neither an address, a CIDR range nor
+// a start-end range, so --forward-first should look it up.
+func isHostname(input string) bool {
+	if strings.Contains(input, "/") || net.ParseIP(input) != nil {
+		return false
+	}
+	// Hostnames often contain hyphens, ranges start with an address
+	start := strings.SplitN(input, "-", 2)[0]
+	return net.ParseIP(strings.TrimSpace(start)) == nil
+}
+
+// isArpa reports whether input is a name under in-addr.arpa or ip6.arpa,
+// such as 4.3.2.1.in-addr.arpa, rather than an address or hostname.
+func isArpa(input string) bool {
+	name := strings.ToLower(strings.TrimSuffix(input, "."))
+	return strings.HasSuffix(name, ".in-addr.arpa") || strings.HasSuffix(name, ".ip6.arpa")
+}
+
+// parseArpa turns a reverse DNS name back into the address it stands for,
+// or returns nil if it doesn't name exactly one address.
+func parseArpa(input string) net.IP {
+	name := strings.ToLower(strings.TrimSuffix(input, "."))
+
+	if labels, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		octets := strings.Split(labels, ".")
+		if len(octets) != 4 {
+			return nil
+		}
+		return net.ParseIP(strings.Join([]string{octets[3], octets[2], octets[1], octets[0]}, ".")).To4()
+	}
+
+	labels, ok := strings.CutSuffix(name, ".ip6.arpa")
+	if !ok {
+		return nil
+	}
+	nibbles := strings.Split(labels, ".")
+	if len(nibbles) != 2*net.IPv6len {
+		return nil
+	}
+	ip := make(net.IP, net.IPv6len)
+	for i, nibble := range nibbles {
+		if len(nibble) != 1 {
+			return nil
+		}
+		value, err := strconv.ParseUint(nibble, 16, 8)
+		if err != nil {
+			return nil
+		}
+		// The last nibble of the address comes first
+		pos := len(nibbles) - 1 - i
+		ip[pos/2] |= byte(value) << (4 * (1 - pos%2))
+	}
+	return ip
+}
+
+// queueHost looks up hostname and queues each address it resolves to that
+// hasn't been queued from another hostname already. A hostname that
+// doesn't resolve is reported as a failure.
+func (g *generator) queueHost(ctx context.Context, hostname, comment string, work chan<- rdns.Target) bool {
+	addrs, err := g.scanner.LookupHost(ctx, hostname)
+	if ctx.Err() != nil {
+		// Keep the hostname itself, it is valid input for a later run
+		if g.leftovers != nil {
+			g.leftovers <- rdns.Result{IP: hostname, Skipped: true, Comment: comment}
+			return true
+		}
+		return false
+	}
+	if err != nil {
+		atomic.AddInt64(&g.stats.unresolved, 1)
+		if g.failures != nil {
+			g.failures <- rdns.Result{IP: hostname, Err: err, Comment: comment}
+		} else {
+			slog.Warn("Failed to resolve hostname", "host", hostname, "err", err)
+		}
+		return true
+	}
+
+	for _, addr := range addrs {
+		if g.seen[addr] {
+			continue
+		}
+		g.seen[addr] = true
+		if !g.queueIP(ctx, work, net.ParseIP(addr), comment) {
+			return false
+		}
+	}
+	return true
+}
+
+// expandHyphenRange queues every address of a start-end range such as
+// 10.0.0.1-10.0.0.255 or the short form 10.0.0.1-255, inclusive.
+func (g *generator) expandHyphenRange(ctx context.Context, input, comment string, work chan<- rdns.Target) bool {
+	start, end, err := parseHyphenRange(input)
+	if err != nil {
+		slog.Warn("Invalid IP range", "input", input, "err", err)
+		atomic.AddInt64(&g.stats.invalid, 1)
+		return true
+	}
+
+	size := new(big.Int).Sub(new(big.Int).SetBytes(end), new(big.Int).SetBytes(start))
+	if !g.allowExpand(input, size.Add(size, big.NewInt(1)), start.To4() == nil) {
+		return true
+	}
+
+	limit := 0
+	if start.To4() == nil {
+		limit = g.opts.MaxHosts
+	}
+
+	for ip, count := start, 0; bytes.Compare(ip, end) <= 0; count++ {
+		if limit > 0 && count >= limit {
+			slog.Warn("Range exceeds --max-hosts, only the first addresses will be queried", "input", input, "max_hosts", limit)
+			break
+		}
+		if !g.queueIP(ctx, work, ip, comment) {
+			return false
+		}
+		if incrementIP(ip) {
+			break
+		}
+	}
+
+	return true
+}
+
+// allowExpand reports whether a range of size addresses may be
+// enumerated. Ranges over --max-expand are skipped with an error unless
+// --force is given, so that a typo such as 0.0.0.0/0 doesn't start a scan
+// of the whole address space. IPv6 ranges are only counted up to
+// --max-hosts, since no more of them are queried.
+func (g *generator) allowExpand(input string, size *big.Int, isV6 bool) bool {
+	if g.opts.Force || g.opts.MaxExpand <= 0 {
+		return true
+	}
+	if maxHosts := big.NewInt(int64(g.opts.MaxHosts)); isV6 && g.opts.MaxHosts > 0 && size.Cmp(maxHosts) > 0 {
+		size = maxHosts
+	}
+	if size.Cmp(big.NewInt(g.opts.MaxExpand)) <= 0 {
+		return true
+	}
+
+	slog.Error("Range is larger than --max-expand, skipping it (use --force to query it anyway)", "input", input, "addresses", size.String(), "max_expand", g.opts.MaxExpand)
+	return false
+}
+
+// parseHyphenRange splits a start-end range into its endpoints, both in the
+// same byte length so they can be compared directly.
+func parseHyphenRange(input string) (net.IP, net.IP, error) {
+	parts := strings.SplitN(input, "-", 2)
+	start := net.ParseIP(strings.TrimSpace(parts[0]))
+	if start == nil {
+		return nil, nil, errors.New("invalid start address")
+	}
+	endStr := strings.TrimSpace(parts[1])
+
+	var end net.IP
+	if v4 := start.To4(); v4 != nil {
+		start = v4
+		if !strings.ContainsAny(endStr, ".:") {
+			// Short form, only the last octet is given
+			octet, err := strconv.Atoi(endStr)
+			if err != nil || octet < 0 || octet > 255 {
+				return nil, nil, errors.New("invalid end octet")
+			}
+			end = net.IPv4(v4[0], v4[1], v4[2], byte(octet)).To4()
+		} else {
+			end = net.ParseIP(endStr)
+			if end == nil {
+				return nil, nil, errors.New("invalid end address")
+			}
+			if end = end.To4(); end == nil {
+				return nil, nil, errors.New("start and end addresses are different families")
+			}
+		}
+	} else {
+		end = net.ParseIP(endStr)
+		if end == nil {
+			return nil, nil, errors.New("invalid end address")
+		}
+		if end.To4() != nil {
+			return nil, nil, errors.New("start and end addresses are different families")
+		}
+	}
+
+	if bytes.Compare(start, end) > 0 {
+		return nil, nil, errors.New("end address is before start address")
+	}
+
+	return start, end, nil
+}
+
+// incrementIP advances ip to the next address in place. IPv4 addresses are
+// incremented within their 4-byte form even when stored in 16 bytes. It
+// reports whether the address wrapped around past the end of its family.
+func incrementIP(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for j := len(ip) - 1; j >= 0; j-- {
+		ip[j]++
+		if ip[j] > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// samePath reports whether a and b refer to the same file path.
+func samePath(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	return absA == absB
+}
+
+// createOutput opens an output file, truncating it unless appending.
+func createOutput(path string, append bool) (*os.File, error) {
+	if append {
+		return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	}
+	return os.Create(path)
+}
+
+// parseResolverEntry validates a resolver given as a bare address, as
+// host:port, as [ipv6]:port or as a DoH URL. Entries with a port keep it,
+// others are queried on --port. Hostnames are resolved to an address once
+// here, except for DoT where the name is needed to check the certificate.
+func parseResolverEntry(entry string, opts *options) (string, error) {
+	if rdns.IsDoH(entry) || net.ParseIP(entry) != nil {
+		return entry, nil
+	}
+
+	// Bracketed IPv6 without a port
+	if strings.HasPrefix(entry, "[") && strings.HasSuffix(entry, "]") {
+		host := entry[1 : len(entry)-1]
+		if net.ParseIP(host) == nil {
+			return "", errors.New("invalid IPv6 address")
+		}
+		return host, nil
+	}
+
+	host, port := entry, ""
+	if strings.Contains(entry, ":") {
+		var err error
+		host, port, err = net.SplitHostPort(entry)
+		if err != nil {
+			return "", err
+		}
+		if host == "" {
+			return "", errors.New("missing host")
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return "", fmt.Errorf("invalid port %q", port)
+		}
+	}
+
+	if net.ParseIP(host) == nil && opts.Protocol != "dot" {
+		addr, err := lookupResolverHost(host, time.Duration(opts.Timeout)*time.Second)
+		if err != nil {
+			return "", err
+		}
+		host = addr
+	}
+
+	if port == "" {
+		return host, nil
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// lookupResolverHost resolves a resolver given by name with the system
+// resolver, preferring an IPv4 address.
+func lookupResolverHost(host string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve %s: %v", host, err)
+	}
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			return addr.IP.String(), nil
+		}
+	}
+	return addrs[0].IP.String(), nil
+}
+
+// showProgress reports progress every interval until stop is closed. It
+// includes how many targets are waiting in work: a full queue means the
+// resolvers are the bottleneck, and an empty one that reading and
+// expanding the input is.
+func showProgress(stop <-chan struct{}, done chan<- struct{}, interval time.Duration, stats *Stats, scanner *rdns.Scanner, work <-chan rdns.Target) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	startTime := time.Now()
+
+	// Draw a bar that updates in place on a terminal, and fall back to a
+	// line per update when stderr is redirected
+	tty := term.IsTerminal(int(os.Stderr.Fd()))
+
+	for {
+		select {
+		case <-stop:
+			if tty {
+				fmt.Fprint(os.Stderr, "\r\033[K")
+			}
+			return
+		case <-ticker.C:
+			counts := scanner.Stats()
+			processed := counts.Processed
+			resolved := counts.Resolved
+			total := atomic.LoadInt64(&stats.total)
+			
+			elapsed := time.Since(startTime)
+			rate := float64(processed) / elapsed.Seconds()
+			
+			if tty {
+				fmt.Fprintf(os.Stderr, "\r\033[K%s %d/%d, %d resolved, %.1f IPs/sec, queued %d/%d%s",
+					progressBar(processed, total), processed, total, resolved, rate, len(work), cap(work), progressETA(total-processed, rate, atomic.LoadInt32(&stats.inputDone) != 0))
+				continue
+			}
+
+			fmt.Fprintf(os.Stderr, "Progress: %d/%d processed, %d resolved, %.1f IPs/sec, queued %d/%d%s\n", 
+				processed, total, resolved, rate, len(work), cap(work), progressETA(total-processed, rate, atomic.LoadInt32(&stats.inputDone) != 0))
+		}
+	}
+}
+
+// progressBar renders processed out of total as a fixed width bar
+// followed by the percentage done.
+func progressBar(processed, total int64) string {
+	const width = 30
+
+	fraction := 0.0
+	if total > 0 {
+		fraction = float64(processed) / float64(total)
+	}
+	// Retry passes count an IP again before dropping its earlier
+	// failure, so processed can briefly run ahead of total
+	if fraction > 1 {
+		fraction = 1
+	}
+	if fraction < 0 {
+		fraction = 0
+	}
+	filled := int(fraction * width)
+	return fmt.Sprintf("[%s%s] %5.1f%%", strings.Repeat("#", filled), strings.Repeat("-", width-filled), fraction*100)
+}
+
+// progressETA estimates the time left to process remaining IPs at rate.
+// Until the input has been fully read the total keeps growing, so the
+// estimate is marked as approximate.
+func progressETA(remaining int64, rate float64, inputDone bool) string {
+	if rate <= 0 {
+		return ""
+	}
+	eta := time.Duration(float64(remaining) / rate * float64(time.Second)).Round(time.Second)
+	if !inputDone {
+		return fmt.Sprintf(", ETA ~%s (input still being read)", eta)
+	}
+	return fmt.Sprintf(", ETA %s", eta)
 }
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/vijay922/rdns/rdns"
+)
+
+// expandAll runs input through g's expandIPRange and returns the
+// addresses it queued, in order.
+func expandAll(t *testing.T, g *generator, input string) []string {
+	t.Helper()
+
+	work := make(chan rdns.Target)
+	done := make(chan []string)
+	go func() {
+		var ips []string
+		for target := range work {
+			ips = append(ips, target.IP)
+		}
+		done <- ips
+	}()
+
+	if !g.expandIPRange(context.Background(), input, "", work) {
+		t.Errorf("expandIPRange(%q) stopped early", input)
+	}
+	close(work)
+	return <-done
+}
+
+// queueAll runs r through queueInput and returns the addresses it
+// queued, in order.
+func queueAll(g *generator, r io.Reader) ([]string, error) {
+	work := make(chan rdns.Target)
+	done := make(chan []string)
+	go func() {
+		var ips []string
+		for target := range work {
+			ips = append(ips, target.IP)
+		}
+		done <- ips
+	}()
+
+	_, err := g.queueInput(context.Background(), r, nil, work)
+	close(work)
+	return <-done, err
+}
+
+func newTestGenerator(opts options) *generator {
+	return &generator{opts: &opts, stats: &Stats{}}
+}
+
+func TestExpandIPRangeCIDR(t *testing.T) {
+	tests := []struct {
+		input       string
+		maxHosts    int
+		count       int
+		first, last string
+	}{
+		{"192.0.2.0/30", 65536, 4, "192.0.2.0", "192.0.2.3"},
+		{"192.0.2.7/31", 65536, 2, "192.0.2.6", "192.0.2.7"},
+		{"192.0.2.9/32", 65536, 1, "192.0.2.9", "192.0.2.9"},
+		{"192.0.2.0/24", 10, 256, "192.0.2.0", "192.0.2.255"},
+		{"255.255.255.254/31", 65536, 2, "255.255.255.254", "255.255.255.255"},
+		{"2001:db8::/126", 65536, 4, "2001:db8::", "2001:db8::3"},
+		{"2001:db8::/127", 65536, 2, "2001:db8::", "2001:db8::1"},
+		{"2001:db8::5/128", 65536, 1, "2001:db8::5", "2001:db8::5"},
+		{"2001:db8::/120", 65536, 256, "2001:db8::", "2001:db8::ff"},
+		{"2001:db8::/120", 100, 100, "2001:db8::", "2001:db8::63"},
+		{"2001:db8::/64", 1000, 1000, "2001:db8::", "2001:db8::3e7"},
+		{"::/0", 10, 10, "::", "::9"},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe/127", 65536, 2, "ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"},
+	}
+
+	for _, tt := range tests {
+		g := newTestGenerator(options{MaxHosts: tt.maxHosts})
+		ips := expandAll(t, g, tt.input)
+		if len(ips) != tt.count {
+			t.Errorf("%s with --max-hosts %d: got %d addresses, want %d", tt.input, tt.maxHosts, len(ips), tt.count)
+			continue
+		}
+		if ips[0] != tt.first || ips[len(ips)-1] != tt.last {
+			t.Errorf("%s: got %s to %s, want %s to %s", tt.input, ips[0], ips[len(ips)-1], tt.first, tt.last)
+		}
+		if total := g.stats.total; total != int64(tt.count) {
+			t.Errorf("%s: counted %d in the total, want %d", tt.input, total, tt.count)
+		}
+	}
+}
+
+func TestExpandIPRangeMaxExpand(t *testing.T) {
+	tests := []struct {
+		input string
+		opts  options
+		count int
+	}{
+		{"10.0.0.0/24", options{MaxExpand: 100}, 0},
+		{"10.0.0.0/24", options{MaxExpand: 100, Force: true}, 256},
+		{"10.0.0.0/25", options{MaxExpand: 128}, 128},
+		// IPv6 ranges are only counted up to --max-hosts
+		{"2001:db8::/64", options{MaxExpand: 1000, MaxHosts: 500}, 500},
+		{"2001:db8::/64", options{MaxExpand: 100, MaxHosts: 500}, 0},
+	}
+
+	for _, tt := range tests {
+		ips := expandAll(t, newTestGenerator(tt.opts), tt.input)
+		if len(ips) != tt.count {
+			t.Errorf("%s with %+v: got %d addresses, want %d", tt.input, tt.opts, len(ips), tt.count)
+		}
+	}
+}
+
+func TestIncrementIP(t *testing.T) {
+	tests := []struct {
+		ip, next string
+		wrapped  bool
+	}{
+		{"192.0.2.1", "192.0.2.2", false},
+		{"192.0.2.255", "192.0.3.0", false},
+		{"255.255.255.255", "0.0.0.0", true},
+		{"2001:db8::ffff", "2001:db8::1:0", false},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "::", true},
+	}
+
+	for _, tt := range tests {
+		// net.ParseIP stores IPv4 in 16 bytes, which must still wrap
+		// within the IPv4 range
+		for _, ip := range []net.IP{net.ParseIP(tt.ip), net.ParseIP(tt.ip).To4()} {
+			if ip == nil {
+				continue
+			}
+			wrapped := incrementIP(ip)
+			if ip.String() != tt.next || wrapped != tt.wrapped {
+				t.Errorf("incrementIP(%s) in %d bytes = %s, %v, want %s, %v", tt.ip, len(ip), ip, wrapped, tt.next, tt.wrapped)
+			}
+		}
+	}
+}
+
+func TestExpandHyphenRange(t *testing.T) {
+	tests := []struct {
+		input       string
+		count       int
+		first, last string
+	}{
+		// Short form, only the last octet of the end is given
+		{"10.0.0.1-5", 5, "10.0.0.1", "10.0.0.5"},
+		{"10.0.0.250-255", 6, "10.0.0.250", "10.0.0.255"},
+		{"10.0.0.7 - 7", 1, "10.0.0.7", "10.0.0.7"},
+		// Full form, which may cross octet boundaries
+		{"192.168.1.10-192.168.1.50", 41, "192.168.1.10", "192.168.1.50"},
+		{"10.0.0.254-10.0.1.1", 4, "10.0.0.254", "10.0.1.1"},
+		{"255.255.255.254-255.255.255.255", 2, "255.255.255.254", "255.255.255.255"},
+		{"2001:db8::fe-2001:db8::101", 4, "2001:db8::fe", "2001:db8::101"},
+	}
+
+	for _, tt := range tests {
+		g := newTestGenerator(options{MaxHosts: 65536})
+		ips := expandAll(t, g, tt.input)
+		if len(ips) != tt.count {
+			t.Errorf("%s: got %d addresses, want %d", tt.input, len(ips), tt.count)
+			continue
+		}
+		if ips[0] != tt.first || ips[len(ips)-1] != tt.last {
+			t.Errorf("%s: got %s to %s, want %s to %s", tt.input, ips[0], ips[len(ips)-1], tt.first, tt.last)
+		}
+		if total := g.stats.total; total != int64(tt.count) {
+			t.Errorf("%s: counted %d in the total, want %d", tt.input, total, tt.count)
+		}
+	}
+}
+
+func TestExpandHyphenRangeInvalid(t *testing.T) {
+	for _, input := range []string{
+		"10.0.0.50-10",
+		"10.0.0.50-10.0.0.10",
+		"10.0.0.1-256",
+		"10.0.0.1-x",
+		"10.0.0.1-2001:db8::1",
+		"2001:db8::1-10.0.0.1",
+		"2001:db8::5-2001:db8::1",
+	} {
+		g := newTestGenerator(options{MaxHosts: 65536})
+		if ips := expandAll(t, g, input); len(ips) != 0 {
+			t.Errorf("%s: queued %v, want nothing", input, ips)
+		}
+		if g.stats.invalid != 1 {
+			t.Errorf("%s: counted %d invalid lines, want 1", input, g.stats.invalid)
+		}
+	}
+}
+
+func TestQueueInputCompressed(t *testing.T) {
+	want := []string{"192.0.2.1", "192.0.2.8", "192.0.2.9", "198.51.100.5", "198.51.100.6", "198.51.100.7"}
+
+	for _, name := range []string{"targets.txt", "targets.txt.gz", "targets.txt.bz2"} {
+		file, err := os.Open(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		g := newTestGenerator(options{MaxHosts: 65536, MaxLineLength: 1 << 20})
+		ips, err := queueAll(g, file)
+		file.Close()
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(ips, want) {
+			t.Errorf("%s: got %v, want %v", name, ips, want)
+		}
+	}
+}
+
+func TestQueueInputCorruptGzip(t *testing.T) {
+	g := newTestGenerator(options{MaxHosts: 65536, MaxLineLength: 1 << 20})
+	if _, err := queueAll(g, strings.NewReader("\x1f\x8b\x08")); err == nil {
+		t.Error("truncated gzip header accepted")
+	}
+}
+
+func TestQueueInputLongLine(t *testing.T) {
+	// A comment longer than bufio's 64KB default token size
+	long := "192.0.2.1 # " + strings.Repeat("x", 100000) + "\n192.0.2.2\n"
+
+	g := newTestGenerator(options{MaxHosts: 65536, MaxLineLength: 1 << 20, Comments: true})
+	ips, err := queueAll(g, strings.NewReader(long))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"192.0.2.1", "192.0.2.2"}; !reflect.DeepEqual(ips, want) {
+		t.Errorf("got %v, want %v", ips, want)
+	}
+
+	g = newTestGenerator(options{MaxHosts: 65536, MaxLineLength: 1000, Comments: true})
+	_, err = queueAll(g, strings.NewReader(long))
+	if err == nil || !strings.Contains(err.Error(), "--max-line-length") {
+		t.Errorf("line over --max-line-length gave %v, want a hint to raise it", err)
+	}
+}
+
+func TestExcludes(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "exclude.txt")
+	excludes := "# upper half\n192.0.2.128/25\n192.0.2.5\nnot-a-range\n2001:db8::1\n"
+	if err := os.WriteFile(filename, []byte(excludes), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		input       string
+		count       int
+		excluded    int64
+		first, last string
+	}{
+		{"192.0.2.0/24", 127, 129, "192.0.2.0", "192.0.2.127"},
+		{"192.0.2.4-192.0.2.6", 2, 1, "192.0.2.4", "192.0.2.6"},
+		{"2001:db8::/126", 3, 1, "2001:db8::", "2001:db8::3"},
+		{"198.51.100.0/30", 4, 0, "198.51.100.0", "198.51.100.3"},
+	}
+
+	for _, tt := range tests {
+		g := newTestGenerator(options{MaxHosts: 65536})
+		g.excludes = loadExcludes(filename, 1<<20)
+		ips := expandAll(t, g, tt.input)
+		if len(ips) != tt.count {
+			t.Errorf("%s: got %d addresses, want %d", tt.input, len(ips), tt.count)
+			continue
+		}
+		if ips[0] != tt.first || ips[len(ips)-1] != tt.last {
+			t.Errorf("%s: got %s to %s, want %s to %s", tt.input, ips[0], ips[len(ips)-1], tt.first, tt.last)
+		}
+		if g.stats.excluded != tt.excluded {
+			t.Errorf("%s: counted %d excluded, want %d", tt.input, g.stats.excluded, tt.excluded)
+		}
+	}
+}
+
+func TestParseArpa(t *testing.T) {
+	for _, ip := range []string{"192.0.2.1", "0.0.0.0", "255.255.255.255", "2001:db8::1", "::", "2001:db8:85a3::8a2e:370:7334", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"} {
+		arpa, err := dns.ReverseAddr(ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{arpa, strings.TrimSuffix(arpa, "."), strings.ToUpper(arpa)} {
+			if got := parseArpa(name); !got.Equal(net.ParseIP(ip)) {
+				t.Errorf("parseArpa(%q) = %v, want %s", name, got, ip)
+			}
+		}
+	}
+}
+
+func TestParseArpaInvalid(t *testing.T) {
+	for _, name := range []string{
+		"2.0.192.in-addr.arpa",
+		"5.1.2.0.192.in-addr.arpa",
+		"256.2.0.192.in-addr.arpa",
+		"x.2.0.192.in-addr.arpa",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.ip6.arpa",
+		"10.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa",
+		"g.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa",
+		"1.2.0.192.example.com",
+	} {
+		if ip := parseArpa(name); ip != nil {
+			t.Errorf("parseArpa(%q) = %s, want nil", name, ip)
+		}
+	}
+}
+
+func TestExpandArpa(t *testing.T) {
+	g := newTestGenerator(options{MaxHosts: 65536})
+	if ips := expandAll(t, g, "1.2.0.192.in-addr.arpa."); len(ips) != 1 || ips[0] != "192.0.2.1" {
+		t.Errorf("got %v, want [192.0.2.1]", ips)
+	}
+
+	g = newTestGenerator(options{MaxHosts: 65536})
+	if ips := expandAll(t, g, "2.0.192.in-addr.arpa"); len(ips) != 0 {
+		t.Errorf("incomplete reverse name queued %v", ips)
+	}
+	if g.stats.invalid != 1 {
+		t.Errorf("counted %d invalid lines, want 1", g.stats.invalid)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/vijay922/rdns/rdns"
+)
+
+// startMetricsServer serves the scan statistics in Prometheus format on
+// /metrics at addr. startTime is used to derive the lookup rate.
+func startMetricsServer(addr string, startTime time.Time, stats *Stats, scanner *rdns.Scanner) *http.Server {
+	registry := prometheus.NewRegistry()
+
+	counters := []struct {
+		name  string
+		help  string
+		value func() int64
+	}{
+		{"ips_total", "IPs queued for lookup.", func() int64 { return atomic.LoadInt64(&stats.total) }},
+		{"ips_resolved_total", "IPs that resolved to at least one PTR record.", func() int64 { return scanner.Stats().Resolved }},
+		{"ips_failed_total", "IPs that failed on every resolver.", func() int64 { return scanner.Stats().Failed }},
+		{"ips_processed_total", "IPs whose lookup has finished.", func() int64 { return scanner.Stats().Processed }},
+	}
+	for _, c := range counters {
+		value := c.value
+		registry.MustRegister(prometheus.NewCounterFunc(
+			prometheus.CounterOpts{Namespace: "rdns", Name: c.name, Help: c.help},
+			func() float64 { return float64(value()) },
+		))
+	}
+
+	registry.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{Namespace: "rdns", Name: "ips_per_second", Help: "Average IPs processed per second since the scan started."},
+		func() float64 {
+			return float64(scanner.Stats().Processed) / time.Since(startTime).Seconds()
+		},
+	))
+
+	// Listen up front so a bad address fails the run instead of being
+	// reported from a background goroutine
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		fatal("Failed to start metrics server", "err", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux}
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			slog.Error("Metrics server failed", "err", err)
+		}
+	}()
+
+	return srv
+}
+
+// stopMetricsServer shuts srv down, giving in-flight scrapes a moment to
+// finish. It is a no-op when srv is nil.
+func stopMetricsServer(srv *http.Server) {
+	if srv == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+}
@@ -0,0 +1,777 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/vijay922/rdns/rdns"
+	"golang.org/x/term"
+)
+
+// jsonResult is a single line of --json output.
+type jsonResult struct {
+	IP         string   `json:"ip"`
+	PTR        []string `json:"ptr,omitempty"`
+	TTL        []uint32 `json:"ttl,omitempty"`
+	Unverified []string `json:"unverified,omitempty"`
+	Resolver   string   `json:"resolver,omitempty"`
+	ASN        uint     `json:"asn,omitempty"`
+	Org        string   `json:"org,omitempty"`
+	Authority  []string `json:"authority,omitempty"`
+	Truncated  bool     `json:"truncated,omitempty"`
+	// PTRTruncated is set when --max-ptr-records left hostnames out.
+	// Truncated was already taken by the TC bit.
+	PTRTruncated bool          `json:"ptr_truncated,omitempty"`
+	Records      []rdns.Record `json:"records,omitempty"`
+	Comment      string        `json:"comment,omitempty"`
+	Error        string        `json:"error,omitempty"`
+	Status       string        `json:"status,omitempty"`
+	// Answers is only set on --report-disagreement records.
+	Answers []jsonAnswer `json:"answers,omitempty"`
+}
+
+// jsonAnswer is one resolver's answer in a --report-disagreement record.
+type jsonAnswer struct {
+	Resolver string   `json:"resolver"`
+	PTR      []string `json:"ptr,omitempty"`
+	Status   string   `json:"status,omitempty"`
+}
+
+// jsonRecord is a single line of --json-flatten output, one per hostname.
+type jsonRecord struct {
+	IP       string  `json:"ip"`
+	Hostname string  `json:"hostname"`
+	TTL      *uint32 `json:"ttl,omitempty"`
+	// Verified is only set with --validate.
+	Verified     *bool    `json:"verified,omitempty"`
+	Resolver     string   `json:"resolver,omitempty"`
+	ASN          uint     `json:"asn,omitempty"`
+	Org          string   `json:"org,omitempty"`
+	Authority    []string `json:"authority,omitempty"`
+	Truncated    bool     `json:"truncated,omitempty"`
+	PTRTruncated bool     `json:"ptr_truncated,omitempty"`
+	// Records are only the --extra-records answers for Hostname.
+	Records []rdns.Record `json:"records,omitempty"`
+	Comment string        `json:"comment,omitempty"`
+}
+
+// ANSI colors for text output to a terminal.
+const (
+	colorGreen = "\033[32m"
+	colorRed   = "\033[31m"
+	colorReset = "\033[0m"
+)
+
+// templateField is one piece of a --format template: either literal text
+// or the name of a placeholder to substitute.
+type templateField struct {
+	literal     string
+	placeholder string
+}
+
+// templatePlaceholders are the names accepted inside {} in --format.
+var templatePlaceholders = map[string]bool{
+	"ip":       true,
+	"ptr":      true,
+	"resolver": true,
+	"ttl":      true,
+	"verified": true,
+	"asn":      true,
+	"org":      true,
+	"comment":  true,
+	"arpa":     true,
+}
+
+// formatPresets are the --format templates behind --format-compat.
+var formatPresets = map[string]string{
+	// massdns -o S: "8.8.8.8.in-addr.arpa. PTR dns.google."
+	"massdns": "{arpa} PTR {ptr}.",
+	// dnsx -ptr -resp: "8.8.8.8 [PTR] [dns.google]"
+	"dnsx": "{ip} [PTR] [{ptr}]",
+}
+
+// parseTemplate splits a --format string into literal text and
+// placeholders. \t and \n in the literal text become a tab and a newline.
+func parseTemplate(format string, opts *options) ([]templateField, error) {
+	escapes := strings.NewReplacer(`\t`, "\t", `\n`, "\n")
+
+	var fields []templateField
+	for format != "" {
+		open := strings.IndexByte(format, '{')
+		if open < 0 {
+			fields = append(fields, templateField{literal: escapes.Replace(format)})
+			break
+		}
+		if open > 0 {
+			fields = append(fields, templateField{literal: escapes.Replace(format[:open])})
+		}
+
+		end := strings.IndexByte(format[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated placeholder %q", format[open:])
+		}
+		name := format[open+1 : open+end]
+		if !templatePlaceholders[name] {
+			return nil, fmt.Errorf("unknown placeholder {%s}", name)
+		}
+		if name == "ttl" && !opts.Raw {
+			return nil, fmt.Errorf("{ttl} requires --raw")
+		}
+		if name == "verified" && !opts.Validate {
+			return nil, fmt.Errorf("{verified} requires --validate")
+		}
+		if (name == "asn" || name == "org") && !opts.Enrich {
+			return nil, fmt.Errorf("{%s} requires --enrich", name)
+		}
+		if name == "comment" && !opts.Comments {
+			return nil, fmt.Errorf("{comment} requires --passthrough-comments")
+		}
+		fields = append(fields, templateField{placeholder: name})
+		format = format[open+end+1:]
+	}
+
+	return fields, nil
+}
+
+// resultWriter formats results in the selected output mode. It is only
+// used from the writer goroutine, so it needs no locking.
+type resultWriter struct {
+	opts  *options
+	stats *Stats
+	// template is the parsed --format template, or nil for the fixed
+	// output formats.
+	template []templateField
+	// asnDB is nil unless --enrich is set.
+	asnDB *maxminddb.Reader
+
+	// seen holds the lines already written, for --unique-output. It is
+	// nil otherwise.
+	seen lineSet
+	// csvColumns is the length of the CSV header, so failure rows can
+	// put their comment in the last column.
+	csvColumns int
+	// color is set when plain text output goes to a terminal, to show
+	// hostnames in green and failures in red.
+	color bool
+	// warnedIPv6 is set once an IPv6 address couldn't be written as
+	// --binary-output=ipv4.
+	warnedIPv6 bool
+	// includeDomains and excludeDomains are the --include-domain and
+	// --exclude-domain domains, lowercased and without surrounding dots.
+	includeDomains []string
+	excludeDomains []string
+	// coverage is nil unless --count-only is set.
+	coverage *coverage
+
+	w         io.Writer
+	buf       *bufio.Writer
+	csv       *csv.Writer
+	failed    io.Writer
+	remaining io.Writer
+}
+
+// newResultWriter sets up output to w, failures to failed and skipped IPs
+// to remaining, the last two only when they are not nil. Any CSV header
+// is written straight away.
+func newResultWriter(opts *options, stats *Stats, template []templateField, asnDB *maxminddb.Reader, w io.Writer, failed io.Writer, remaining io.Writer) *resultWriter {
+	rw := &resultWriter{opts: opts, stats: stats, template: template, asnDB: asnDB, w: w, failed: failed, remaining: remaining}
+
+	for _, domain := range opts.IncludeDomains {
+		rw.includeDomains = append(rw.includeDomains, strings.ToLower(strings.Trim(domain, ".")))
+	}
+	for _, domain := range opts.ExcludeDomains {
+		rw.excludeDomains = append(rw.excludeDomains, strings.ToLower(strings.Trim(domain, ".")))
+	}
+
+	if opts.CountOnly {
+		rw.coverage = newCoverage(opts.CoverageHistogram)
+	}
+
+	// Never color a file or a pipe, or anything meant to be parsed
+	if f, ok := w.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		rw.color = !opts.NoColor && os.Getenv("NO_COLOR") == "" && !opts.JSON && !opts.CSV && template == nil
+	}
+
+	// --tee copies everything to stdout. Both sit under the buffer, so a
+	// flush reaches both.
+	if opts.Tee {
+		rw.w = io.MultiWriter(w, os.Stdout)
+	}
+
+	if opts.UniqueApprox {
+		rw.seen = newBloomSet()
+	} else if opts.UniqueOutput {
+		rw.seen = exactSet{}
+	}
+
+	// Buffer output so writing doesn't cost a syscall per line
+	if opts.OutputBuffer > 0 {
+		rw.buf = bufio.NewWriterSize(rw.w, opts.OutputBuffer)
+		rw.w = rw.buf
+	}
+
+	// --only-without-ptr prints bare IPs, whatever the output format
+	if opts.CSV && !opts.OnlyWithoutPTR {
+		rw.csv = csv.NewWriter(rw.w)
+		header := []string{"ip", "hostname", "resolver"}
+		if opts.Domain {
+			header = []string{"hostname"}
+		}
+		if opts.Validate {
+			header = append(header, "verified")
+		}
+		if opts.Enrich {
+			header = append(header, "asn", "org")
+		}
+		if opts.MaxPTRRecords > 0 {
+			header = append(header, "dropped_ptr")
+		}
+		if opts.Comments {
+			header = append(header, "comment")
+		}
+		rw.csvColumns = len(header)
+		var encoded bytes.Buffer
+		cw := csv.NewWriter(&encoded)
+		cw.Write(header)
+		cw.Flush()
+
+		// Every file of a rotated output gets its own header, and a file
+		// being appended to already has one
+		var err error
+		if rotating, ok := w.(*rotatingOutput); ok {
+			err = rotating.setHeader(encoded.Bytes())
+		} else if !hasData(w) {
+			_, err = w.Write(encoded.Bytes())
+		}
+		if err == nil && opts.Tee {
+			_, err = os.Stdout.Write(encoded.Bytes())
+		}
+		if err != nil {
+			slog.Error("Failed to write CSV", "err", err)
+		}
+	}
+
+	return rw
+}
+
+// hasData reports whether w is a regular file that already has content,
+// as happens with --append.
+func hasData(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode().IsRegular() && info.Size() > 0
+}
+
+// run writes every result received until results is closed, flushing the
+// buffer every second so output still shows up promptly. done is closed
+// once everything has been flushed.
+func (rw *resultWriter) run(results <-chan rdns.Result, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case result, ok := <-results:
+			if !ok {
+				if rw.coverage != nil {
+					if err := rw.coverage.write(rw.w, rw.opts.JSON); err != nil {
+						slog.Error("Failed to write output", "err", err)
+					}
+				}
+				rw.flush()
+				return
+			}
+			rw.write(result)
+		case <-ticker.C:
+			rw.flush()
+		}
+	}
+}
+
+// write outputs a single result in the selected format.
+func (rw *resultWriter) write(result rdns.Result) {
+	if result.Skipped {
+		if rw.remaining != nil {
+			fmt.Fprintln(rw.remaining, withComment(result.IP, result.Comment))
+		}
+		return
+	}
+
+	// --count-only only tallies, though --failed-output still gets the
+	// failures
+	if rw.coverage != nil {
+		rw.coverage.add(result)
+		if result.Err != nil && rw.failed != nil {
+			rw.writeFailed(result)
+		}
+		return
+	}
+
+	if rw.opts.OnlyWithoutPTR {
+		if result.Err == nil {
+			return
+		}
+		if rw.opts.BinaryOutput != "" {
+			rw.writeBinary(result.IP)
+		} else {
+			fmt.Fprintln(rw.w, withComment(rw.displayIP(result.IP), result.Comment))
+		}
+		if rw.failed != nil {
+			rw.writeFailed(result)
+		}
+		return
+	}
+
+	switch {
+	case result.Err != nil && rw.failed != nil:
+		rw.writeFailed(result)
+	case result.Err != nil && rw.opts.ShowFailed:
+		rw.writeFailure(result)
+	case result.Err == nil && len(result.Hostnames) > 0:
+		rw.writeResult(result)
+	}
+
+	if rw.opts.ReportDisagree && len(result.Answers) > 0 {
+		rw.writeDisagreement(result)
+	}
+}
+
+// writeDisagreement writes a record listing what each resolver returned
+// for an IP they didn't agree on, for --report-disagreement: a JSON
+// object with the status "disagreement", or a line such as
+// "192.0.2.1	DISAGREE	1.1.1.1=a.example.com	8.8.8.8=NXDOMAIN".
+func (rw *resultWriter) writeDisagreement(result rdns.Result) {
+	ip := rw.displayIP(result.IP)
+	if rw.opts.JSON {
+		line := jsonResult{IP: ip, Status: "disagreement", Comment: result.Comment}
+		for _, answer := range result.Answers {
+			entry := jsonAnswer{Resolver: answer.Resolver, PTR: answer.Hostnames}
+			if len(answer.Hostnames) == 0 {
+				entry.Status = rdns.StatusNXDomain
+			}
+			line.Answers = append(line.Answers, entry)
+		}
+		rw.writeJSON(line)
+		return
+	}
+
+	line := ip + "\t" + rw.paint("DISAGREE", colorRed)
+	for _, answer := range result.Answers {
+		hostnames := "NXDOMAIN"
+		if len(answer.Hostnames) > 0 {
+			hostnames = strings.Join(answer.Hostnames, ",")
+		}
+		line += "\t" + answer.Resolver + "=" + hostnames
+	}
+	line = withComment(line, result.Comment)
+	if rw.isNew(line) {
+		fmt.Fprintln(rw.w, line)
+	}
+}
+
+// writeResult prints the hostnames resolved for an IP. Verified is only set
+// when --validate is in use.
+func (rw *resultWriter) writeResult(result rdns.Result) {
+	if rw.includeDomains != nil || rw.excludeDomains != nil {
+		result = rw.filterDomains(result)
+		if len(result.Hostnames) == 0 {
+			return
+		}
+	}
+	if rw.opts.BinaryOutput != "" {
+		rw.writeBinary(result.IP)
+		return
+	}
+	if rw.opts.Lowercase {
+		// A copy, since the cache may hold the same slice
+		lowered := make([]string, len(result.Hostnames))
+		for i, hostname := range result.Hostnames {
+			lowered[i] = strings.ToLower(hostname)
+		}
+		result.Hostnames = lowered
+	}
+
+	resolverIP, hostnames, verified := result.Resolver, result.Hostnames, result.Verified
+	asn, org := lookupASN(rw.asnDB, result.IP)
+	ip := rw.displayIP(result.IP)
+
+	if rw.opts.JSONFlatten {
+		for i, hostname := range hostnames {
+			line := jsonRecord{
+				IP:           ip,
+				Hostname:     hostname,
+				Resolver:     resolverIP,
+				ASN:          asn,
+				Org:          org,
+				Authority:    result.Authority,
+				Truncated:    result.Truncated,
+				PTRTruncated: result.Dropped > 0,
+			}
+			if result.TTLs != nil {
+				line.TTL = &result.TTLs[i]
+			}
+			if rw.opts.Validate {
+				line.Verified = &verified[i]
+			}
+			for _, record := range result.Records {
+				if strings.EqualFold(record.Name, hostname) {
+					line.Records = append(line.Records, record)
+				}
+			}
+			line.Comment = result.Comment
+			rw.writeJSON(line)
+		}
+		return
+	}
+
+	if rw.opts.JSON {
+		line := jsonResult{
+			IP:           ip,
+			Resolver:     resolverIP,
+			ASN:          asn,
+			Org:          org,
+			Authority:    result.Authority,
+			Truncated:    result.Truncated,
+			PTRTruncated: result.Dropped > 0,
+			Records:      result.Records,
+			Comment:      result.Comment,
+		}
+		for i, hostname := range hostnames {
+			if rw.opts.Validate && !verified[i] {
+				line.Unverified = append(line.Unverified, hostname)
+				continue
+			}
+			line.PTR = append(line.PTR, hostname)
+			if result.TTLs != nil {
+				line.TTL = append(line.TTL, result.TTLs[i])
+			}
+		}
+		rw.writeJSON(line)
+		return
+	}
+
+	if rw.template != nil {
+		for i := range hostnames {
+			rw.writeTemplate(result, i, asn, org)
+		}
+		return
+	}
+
+	if rw.opts.CSV {
+		for i, hostname := range hostnames {
+			record := []string{ip, hostname, resolverIP}
+			if rw.opts.Domain {
+				record = []string{hostname}
+			}
+			if rw.opts.Validate {
+				record = append(record, strconv.FormatBool(verified[i]))
+			}
+			if rw.opts.Enrich {
+				record = append(record, formatASN(asn), org)
+			}
+			if rw.opts.MaxPTRRecords > 0 {
+				record = append(record, strconv.Itoa(result.Dropped))
+			}
+			if rw.opts.Comments {
+				record = append(record, result.Comment)
+			}
+			rw.writeCSV(record)
+		}
+		return
+	}
+
+	// The last line written for an IP capped by --max-ptr-records says
+	// how many hostnames were left out
+	last := len(hostnames) - 1
+	if rw.opts.Domain && rw.opts.Validate {
+		for last >= 0 && !verified[last] {
+			last--
+		}
+	}
+
+	for i, hostname := range hostnames {
+		line := rw.paint(hostname, colorGreen)
+		if !rw.opts.Domain {
+			line = ip + "\t" + line
+		}
+
+		if rw.opts.Validate {
+			switch {
+			case rw.opts.Domain && !verified[i]:
+				// No column to mark the result, so drop unverified names
+				continue
+			case rw.opts.Domain:
+			case verified[i]:
+				line += "\tVERIFIED"
+			default:
+				line += "\tUNVERIFIED"
+			}
+		}
+
+		if rw.opts.Enrich && !rw.opts.Domain {
+			line += "\t" + formatASN(asn) + "\t" + org
+		}
+
+		// The resolver goes last so parsers reading the leading fields
+		// are unaffected
+		if rw.opts.ShowResolver {
+			line += "\t" + resolverIP
+		}
+		if i == last && result.Dropped > 0 {
+			line += fmt.Sprintf("\t(+%d more)", result.Dropped)
+		}
+		line = withComment(line, result.Comment)
+
+		if rw.isNew(line) {
+			fmt.Fprintln(rw.w, line)
+		}
+	}
+}
+
+// filterDomains returns result with only the hostnames under an
+// --include-domain, if any were given, and none under an
+// --exclude-domain, counting those it leaves out. A hostname matching
+// both is left out. The IP itself still counts as resolved.
+func (rw *resultWriter) filterDomains(result rdns.Result) rdns.Result {
+	// New slices, since the cache may hold the same ones
+	kept := result
+	kept.Hostnames, kept.TTLs, kept.Verified, kept.Records = nil, nil, nil, nil
+	for i, hostname := range result.Hostnames {
+		if rw.includeDomains != nil && !inDomains(hostname, rw.includeDomains) {
+			atomic.AddInt64(&rw.stats.domainNotIncluded, 1)
+			continue
+		}
+		if inDomains(hostname, rw.excludeDomains) {
+			atomic.AddInt64(&rw.stats.domainExcluded, 1)
+			continue
+		}
+		kept.Hostnames = append(kept.Hostnames, hostname)
+		if result.TTLs != nil {
+			kept.TTLs = append(kept.TTLs, result.TTLs[i])
+		}
+		if result.Verified != nil {
+			kept.Verified = append(kept.Verified, result.Verified[i])
+		}
+		for _, record := range result.Records {
+			if strings.EqualFold(record.Name, hostname) {
+				kept.Records = append(kept.Records, record)
+			}
+		}
+	}
+	return kept
+}
+
+// inDomains reports whether hostname is one of domains or under one.
+// Matching stops at a dot, so ample.com doesn't match example.com.
+func inDomains(hostname string, domains []string) bool {
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	for _, domain := range domains {
+		if hostname == domain || strings.HasSuffix(hostname, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTemplate prints the i'th hostname of a result using --format.
+func (rw *resultWriter) writeTemplate(result rdns.Result, i int, asn uint, org string) {
+	var line strings.Builder
+	for _, field := range rw.template {
+		switch field.placeholder {
+		case "":
+			line.WriteString(field.literal)
+		case "ip":
+			line.WriteString(rw.displayIP(result.IP))
+		case "arpa":
+			arpa, _ := dns.ReverseAddr(result.IP)
+			line.WriteString(arpa)
+		case "ptr":
+			line.WriteString(result.Hostnames[i])
+		case "resolver":
+			line.WriteString(result.Resolver)
+		case "ttl":
+			if result.TTLs != nil {
+				line.WriteString(strconv.FormatUint(uint64(result.TTLs[i]), 10))
+			}
+		case "asn":
+			line.WriteString(formatASN(asn))
+		case "org":
+			line.WriteString(org)
+		case "comment":
+			line.WriteString(result.Comment)
+		case "verified":
+			if result.Verified[i] {
+				line.WriteString("VERIFIED")
+			} else {
+				line.WriteString("UNVERIFIED")
+			}
+		}
+	}
+	if rw.isNew(line.String()) {
+		fmt.Fprintln(rw.w, line.String())
+	}
+}
+
+// formatASN renders an AS number as AS15169, or blank when unknown.
+func formatASN(asn uint) string {
+	if asn == 0 {
+		return ""
+	}
+	return "AS" + strconv.FormatUint(uint64(asn), 10)
+}
+
+// writeFailure prints an IP as unresolved in the selected output format.
+func (rw *resultWriter) writeFailure(result rdns.Result) {
+	switch {
+	case rw.opts.JSON:
+		rw.writeJSON(jsonResult{IP: rw.displayIP(result.IP), Comment: result.Comment, Error: result.Err.Error(), Status: rdns.Classify(result.Err)})
+	case rw.opts.CSV:
+		// A hostname-only CSV has nowhere to put the IP. The row is
+		// padded to the header, with any comment in the last column.
+		if !rw.opts.Domain {
+			columns := rw.csvColumns
+			if rw.opts.Comments {
+				columns--
+			}
+			record := []string{rw.displayIP(result.IP)}
+			for len(record) < columns {
+				record = append(record, "")
+			}
+			if rw.opts.Comments {
+				record = append(record, result.Comment)
+			}
+			rw.writeCSV(record)
+		}
+	default:
+		line := fmt.Sprintf("%s\t%s\t%s", rw.displayIP(result.IP), rw.paint("FAILED", colorRed), strings.ToUpper(rdns.Classify(result.Err)))
+		fmt.Fprintln(rw.w, withComment(line, result.Comment))
+	}
+}
+
+// writeFailed writes a failed IP and its last error to --failed-output.
+func (rw *resultWriter) writeFailed(result rdns.Result) {
+	line := fmt.Sprintf("%s\t%s", rw.displayIP(result.IP), result.Err)
+	fmt.Fprintln(rw.failed, withComment(line, result.Comment))
+}
+
+// withComment appends the --passthrough-comments comment of an IP to a
+// line of text output. It is left as a # comment, so lines that are read
+// back as input keep it.
+func withComment(line, comment string) string {
+	if comment == "" {
+		return line
+	}
+	return line + "\t# " + comment
+}
+
+// paint wraps text in color when output is colored.
+func (rw *resultWriter) paint(text, color string) string {
+	if !rw.color {
+		return text
+	}
+	return color + text + colorReset
+}
+
+// displayIP formats ip for output. With --pad-ip, IPv4 octets are zero
+// padded and IPv6 addresses written out in full, so sorting the output as
+// text sorts it by address. Anything that isn't an address, such as a
+// --forward-first hostname, is left alone.
+func (rw *resultWriter) displayIP(ip string) string {
+	if !rw.opts.PadIP {
+		return ip
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+
+	if v4 := parsed.To4(); v4 != nil {
+		return fmt.Sprintf("%03d.%03d.%03d.%03d", v4[0], v4[1], v4[2], v4[3])
+	}
+	groups := make([]string, 8)
+	for i := range groups {
+		groups[i] = fmt.Sprintf("%02x%02x", parsed[2*i], parsed[2*i+1])
+	}
+	return strings.Join(groups, ":")
+}
+
+// writeBinary writes ip packed into 4 bytes, or 16 for
+// --binary-output=ipv6. Anything that isn't an address, such as a
+// --forward-first hostname, is left out, as are IPv6 addresses that
+// don't fit in 4 bytes.
+func (rw *resultWriter) writeBinary(ip string) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return
+	}
+	if rw.opts.BinaryOutput == "ipv4" {
+		if addr = addr.To4(); addr == nil {
+			if !rw.warnedIPv6 {
+				slog.Warn("IPv6 addresses are left out of --binary-output=ipv4, use --binary-output=ipv6 to keep them")
+				rw.warnedIPv6 = true
+			}
+			return
+		}
+	}
+	if rw.isNew(string(addr)) {
+		rw.w.Write(addr)
+	}
+}
+
+// writeCSV writes a single CSV record.
+func (rw *resultWriter) writeCSV(record []string) {
+	if !rw.isNew(strings.Join(record, "\x00")) {
+		return
+	}
+	rw.csv.Write(record)
+	rw.csv.Flush()
+	if err := rw.csv.Error(); err != nil {
+		slog.Error("Failed to write CSV", "err", err)
+	}
+}
+
+// writeJSON writes v as a single line.
+func (rw *resultWriter) writeJSON(v interface{}) {
+	line, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("Failed to encode result", "err", err)
+		return
+	}
+	if rw.isNew(string(line)) {
+		rw.w.Write(append(line, '\n'))
+	}
+}
+
+// isNew reports whether line hasn't been written before, and is always
+// true without --unique-output.
+func (rw *resultWriter) isNew(line string) bool {
+	return rw.seen == nil || rw.seen.add(line)
+}
+
+// flush writes out anything held in the output buffer.
+func (rw *resultWriter) flush() {
+	if rw.buf == nil {
+		return
+	}
+	if err := rw.buf.Flush(); err != nil {
+		slog.Error("Failed to write output", "err", err)
+	}
+}
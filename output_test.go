@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"math/rand"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vijay922/rdns/rdns"
+)
+
+func TestWriteJSON(t *testing.T) {
+	results := []rdns.Result{
+		{IP: "192.0.2.1", Hostnames: []string{"a.example.com", "b.example.com"}, Resolver: "8.8.8.8"},
+		{IP: "192.0.2.2", Err: &net.DNSError{Err: "i/o timeout", Name: "2.2.0.192.in-addr.arpa", IsTimeout: true}},
+		{IP: "192.0.2.3", Err: rdns.ErrNoPTR, Comment: "lab"},
+		{IP: "192.0.2.4", Skipped: true},
+	}
+	want := []jsonResult{
+		{IP: "192.0.2.1", PTR: []string{"a.example.com", "b.example.com"}, Resolver: "8.8.8.8"},
+		{IP: "192.0.2.2", Error: "lookup 2.2.0.192.in-addr.arpa: i/o timeout", Status: rdns.StatusTimeout},
+		{IP: "192.0.2.3", Error: rdns.ErrNoPTR.Error(), Status: rdns.StatusNXDomain, Comment: "lab"},
+	}
+
+	var out bytes.Buffer
+	rw := newResultWriter(&options{JSON: true, ShowFailed: true}, &Stats{}, nil, nil, &out, nil, nil)
+	for _, result := range results {
+		rw.write(result)
+	}
+	rw.flush()
+
+	var got []jsonResult
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var line jsonResult
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("line %q isn't valid JSON: %v", scanner.Text(), err)
+		}
+		got = append(got, line)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestWriteJSONWithoutFailures(t *testing.T) {
+	var out bytes.Buffer
+	rw := newResultWriter(&options{JSON: true}, &Stats{}, nil, nil, &out, nil, nil)
+	rw.write(rdns.Result{IP: "192.0.2.2", Err: rdns.ErrNoPTR})
+	rw.flush()
+
+	if out.Len() != 0 {
+		t.Errorf("failure written without --show-failed: %q", out.String())
+	}
+}
+
+// The writer benchmarks compare sending results from many workers to the
+// single writer goroutine, as main does, with every worker taking a lock
+// around its own write. Each worker sleeps before every result, standing
+// in for the lookup, and output goes to a real file so flushes cost a
+// system call. Besides ns/op they report wait-ns/op, the time a worker
+// spends blocked handing over a result instead of starting its next
+// lookup.
+
+var benchResult = rdns.Result{IP: "192.0.2.1", Hostnames: []string{"host-1.example.com"}, Resolver: "8.8.8.8"}
+
+// benchWriter returns a result writer to a temporary file.
+func benchWriter(b *testing.B) *resultWriter {
+	b.Helper()
+
+	file, err := os.CreateTemp(b.TempDir(), "out")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { file.Close() })
+	return newResultWriter(&options{JSON: true}, &Stats{}, nil, nil, file, nil, nil)
+}
+
+// benchWorkers runs handOver after each simulated lookup, taking 5 to
+// 15ms, from 64 workers per CPU and reports the mean time each call
+// took as wait-ns/op.
+func benchWorkers(b *testing.B, handOver func()) {
+	var waited atomic.Int64
+	b.SetParallelism(64)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			time.Sleep(time.Duration(5000+rand.Intn(10000)) * time.Microsecond)
+			start := time.Now()
+			handOver()
+			waited.Add(int64(time.Since(start)))
+		}
+	})
+	b.ReportMetric(float64(waited.Load())/float64(b.N), "wait-ns/op")
+}
+
+func BenchmarkResultWriterChannel(b *testing.B) {
+	rw := benchWriter(b)
+	results := make(chan rdns.Result, runtime.GOMAXPROCS(0))
+	done := make(chan struct{})
+	go rw.run(results, done)
+
+	benchWorkers(b, func() { results <- benchResult })
+	close(results)
+	<-done
+}
+
+func BenchmarkResultWriterMutex(b *testing.B) {
+	rw := benchWriter(b)
+	var mu sync.Mutex
+
+	benchWorkers(b, func() {
+		mu.Lock()
+		rw.write(benchResult)
+		mu.Unlock()
+	})
+	rw.flush()
+}
+
+func TestWriteCSVFailures(t *testing.T) {
+	tests := []struct {
+		opts options
+		want [][]string
+	}{
+		{
+			options{CSV: true, ShowFailed: true},
+			[][]string{{"ip", "hostname", "resolver"}, {"192.0.2.1", "a.example.com", "8.8.8.8"}, {"192.0.2.2", "", ""}},
+		},
+		{
+			options{CSV: true, ShowFailed: true, Validate: true},
+			[][]string{{"ip", "hostname", "resolver", "verified"}, {"192.0.2.1", "a.example.com", "8.8.8.8", "true"}, {"192.0.2.2", "", "", ""}},
+		},
+		{
+			options{CSV: true, ShowFailed: true, Validate: true, Comments: true},
+			[][]string{{"ip", "hostname", "resolver", "verified", "comment"}, {"192.0.2.1", "a.example.com", "8.8.8.8", "true", "lab"}, {"192.0.2.2", "", "", "", "lab"}},
+		},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		rw := newResultWriter(&tt.opts, &Stats{}, nil, nil, &out, nil, nil)
+		rw.write(rdns.Result{IP: "192.0.2.1", Hostnames: []string{"a.example.com"}, Verified: []bool{true}, Resolver: "8.8.8.8", Comment: "lab"})
+		rw.write(rdns.Result{IP: "192.0.2.2", Err: rdns.ErrNoPTR, Comment: "lab"})
+		rw.flush()
+
+		// csv.Reader rejects rows with a different number of fields
+		got, err := csv.NewReader(&out).ReadAll()
+		if err != nil {
+			t.Errorf("%+v: %v in %q", tt.opts, err, out.String())
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: got %q, want %q", tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestWriteMaxPTRRecords(t *testing.T) {
+	capped := rdns.Result{IP: "192.0.2.1", Hostnames: []string{"a.example.com", "b.example.com"}, Resolver: "8.8.8.8", Dropped: 3}
+	whole := rdns.Result{IP: "192.0.2.2", Hostnames: []string{"c.example.com"}, Resolver: "8.8.8.8"}
+
+	tests := []struct {
+		opts options
+		want string
+	}{
+		{
+			options{MaxPTRRecords: 2},
+			"192.0.2.1\ta.example.com\n192.0.2.1\tb.example.com\t(+3 more)\n192.0.2.2\tc.example.com\n",
+		},
+		{
+			options{MaxPTRRecords: 2, ShowResolver: true},
+			"192.0.2.1\ta.example.com\t8.8.8.8\n192.0.2.1\tb.example.com\t8.8.8.8\t(+3 more)\n192.0.2.2\tc.example.com\t8.8.8.8\n",
+		},
+		{
+			options{MaxPTRRecords: 2, CSV: true},
+			"ip,hostname,resolver,dropped_ptr\n192.0.2.1,a.example.com,8.8.8.8,3\n192.0.2.1,b.example.com,8.8.8.8,3\n192.0.2.2,c.example.com,8.8.8.8,0\n",
+		},
+		{
+			options{MaxPTRRecords: 2, JSON: true},
+			`{"ip":"192.0.2.1","ptr":["a.example.com","b.example.com"],"resolver":"8.8.8.8","ptr_truncated":true}` + "\n" +
+				`{"ip":"192.0.2.2","ptr":["c.example.com"],"resolver":"8.8.8.8"}` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		rw := newResultWriter(&tt.opts, &Stats{}, nil, nil, &out, nil, nil)
+		rw.write(capped)
+		rw.write(whole)
+		rw.flush()
+
+		if out.String() != tt.want {
+			t.Errorf("%+v: got\n%s\nwant\n%s", tt.opts, out.String(), tt.want)
+		}
+	}
+}
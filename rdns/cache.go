@@ -0,0 +1,226 @@
+package rdns
+
+import (
+	"bufio"
+	"compress/gzip"
+	"container/list"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Cache is an LRU cache of lookups that succeeded, so an IP seen more than
+// once is only queried the first time. A nil *Cache caches nothing.
+type Cache struct {
+	mu        sync.Mutex
+	size      int
+	ttl       time.Duration
+	recordTTL bool // set by UseRecordTTL
+	order     *list.List
+	entries   map[string]*list.Element
+}
+
+// cacheEntry is the value held in Cache.order.
+type cacheEntry struct {
+	result Result
+	stored time.Time
+}
+
+// NewCache returns a cache holding up to size results, or any number when
+// size is 0. Results older than ttl are looked up again, unless ttl is 0.
+func NewCache(size int, ttl time.Duration) *Cache {
+	return &Cache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// UseRecordTTL makes entries that carry TTLs, which only Config.Raw
+// lookups do, expire once the lowest of them has elapsed, or sooner if
+// the cache's own ttl is shorter. Call it before the cache is used.
+func (c *Cache) UseRecordTTL() {
+	c.recordTTL = true
+}
+
+// expired reports whether result, cached at stored, should be looked up
+// again at now.
+func (c *Cache) expired(result Result, stored, now time.Time) bool {
+	age := now.Sub(stored)
+	if c.ttl > 0 && age > c.ttl {
+		return true
+	}
+	if !c.recordTTL || len(result.TTLs) == 0 {
+		return false
+	}
+	lowest := result.TTLs[0]
+	for _, ttl := range result.TTLs[1:] {
+		lowest = min(lowest, ttl)
+	}
+	return age >= time.Duration(lowest)*time.Second
+}
+
+// Get returns the cached result for ip, marking it recently used.
+func (c *Cache) Get(ip string) (Result, bool) {
+	if c == nil {
+		return Result{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[ip]
+	if !ok {
+		return Result{}, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if c.expired(entry.result, entry.stored, time.Now()) {
+		c.order.Remove(elem)
+		delete(c.entries, ip)
+		return Result{}, false
+	}
+
+	c.order.MoveToFront(elem)
+	return entry.result, true
+}
+
+// Add caches a successful result, evicting the least recently used entry
+// once the cache is full.
+func (c *Cache) Add(result Result) {
+	if c == nil {
+		return
+	}
+	c.add(result, time.Now())
+}
+
+func (c *Cache) add(result Result, stored time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[result.IP]; ok {
+		elem.Value = &cacheEntry{result: result, stored: stored}
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[result.IP] = c.order.PushFront(&cacheEntry{result: result, stored: stored})
+	if c.size > 0 && c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).result.IP)
+	}
+}
+
+// cacheFileEntry is one line of a saved cache.
+type cacheFileEntry struct {
+	IP        string    `json:"ip"`
+	PTR       []string  `json:"ptr"`
+	TTL       []uint32  `json:"ttl,omitempty"`
+	Authority []string  `json:"authority,omitempty"`
+	Truncated bool      `json:"truncated,omitempty"`
+	Dropped   int       `json:"dropped,omitempty"`
+	Records   []Record  `json:"records,omitempty"`
+	Verified  []bool    `json:"verified,omitempty"`
+	Resolver  string    `json:"resolver"`
+	Time      time.Time `json:"time"`
+}
+
+// Load reads a cache written by Save. A missing file is not an error, since
+// the first run has nothing to load. Entries that have expired are skipped.
+// An entry's TTLs and the time it was looked up are saved with it, so
+// entries loaded with UseRecordTTL expire when they would have in the run
+// that stored them.
+func (c *Cache) Load(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	decoder := json.NewDecoder(gz)
+	for decoder.More() {
+		var entry cacheFileEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return err
+		}
+		result := Result{
+			IP:        entry.IP,
+			Hostnames: entry.PTR,
+			TTLs:      entry.TTL,
+			Authority: entry.Authority,
+			Truncated: entry.Truncated,
+			Dropped:   entry.Dropped,
+			Records:   entry.Records,
+			Verified:  entry.Verified,
+			Resolver:  entry.Resolver,
+		}
+		if c.expired(result, entry.Time, time.Now()) {
+			continue
+		}
+		c.add(result, entry.Time)
+	}
+	return nil
+}
+
+// Save writes the cache to path as gzipped JSON Lines, least recently used
+// first so that loading it again keeps the same order. It writes to a
+// temporary file first so an interrupted save can't lose the old cache.
+func (c *Cache) Save(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	buf := bufio.NewWriter(file)
+	gz := gzip.NewWriter(buf)
+	encoder := json.NewEncoder(gz)
+	for elem := c.order.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(*cacheEntry)
+		err := encoder.Encode(cacheFileEntry{
+			IP:        entry.result.IP,
+			PTR:       entry.result.Hostnames,
+			TTL:       entry.result.TTLs,
+			Authority: entry.result.Authority,
+			Truncated: entry.result.Truncated,
+			Dropped:   entry.result.Dropped,
+			Records:   entry.result.Records,
+			Verified:  entry.result.Verified,
+			Resolver:  entry.result.Resolver,
+			Time:      entry.stored,
+		})
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if err := gz.Close(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,198 @@
+package rdns
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// resolverHost returns resolver without any port it was given with.
+func resolverHost(resolver string) string {
+	if host, _, err := net.SplitHostPort(resolver); err == nil {
+		return host
+	}
+	return resolver
+}
+
+// resolverAddr returns the host:port address to query resolver on, using
+// Config.Port unless the resolver entry carries its own. IPv6 addresses
+// are bracketed, and the dialer picks the matching network from them.
+func (s *Scanner) resolverAddr(resolver string) string {
+	if _, _, err := net.SplitHostPort(resolver); err == nil {
+		return resolver
+	}
+	return net.JoinHostPort(resolver, strconv.Itoa(int(s.cfg.Port)))
+}
+
+// dialResolver connects to resolverIP using the configured protocol. For
+// DNS-over-TLS the handshake is bounded by the same timeout as the dial.
+// network is what net.Resolver asked for, which is TCP when it retries a
+// truncated UDP response. TCP and DNS-over-TLS connections are taken from
+// the pool when Config.ConnPoolSize is set, and go back to it on Close.
+func (s *Scanner) dialResolver(ctx context.Context, network, resolverIP string) (net.Conn, error) {
+	if s.pool == nil || (s.cfg.Protocol == "udp" && !strings.HasPrefix(network, "tcp")) {
+		return s.dialConn(ctx, network, resolverIP)
+	}
+
+	conn := s.pool.get(resolverIP)
+	if conn == nil {
+		var err error
+		if conn, err = s.dialConn(ctx, network, resolverIP); err != nil {
+			return nil, err
+		}
+	}
+	return &pooledConn{Conn: conn, pool: s.pool, resolverIP: resolverIP}, nil
+}
+
+// dialConn opens a new connection to resolverIP for dialResolver.
+func (s *Scanner) dialConn(ctx context.Context, network, resolverIP string) (net.Conn, error) {
+	if s.proxy != nil {
+		return s.dialProxy(ctx, resolverIP)
+	}
+
+	dialNetwork := s.cfg.Protocol
+	if s.cfg.Protocol == "dot" || strings.HasPrefix(network, "tcp") {
+		dialNetwork = "tcp"
+	}
+	d := &net.Dialer{
+		Timeout:   s.cfg.Timeout,
+		LocalAddr: s.localAddr(dialNetwork),
+	}
+
+	if s.cfg.Protocol == "dot" {
+		td := &tls.Dialer{NetDialer: d, Config: s.tlsConfig(resolverIP)}
+		return td.DialContext(ctx, "tcp", s.resolverAddr(resolverIP))
+	}
+
+	return d.DialContext(ctx, dialNetwork, s.resolverAddr(resolverIP))
+}
+
+// localAddr returns the Config.SourceIP address to dial network from, or
+// nil to let the system choose.
+func (s *Scanner) localAddr(network string) net.Addr {
+	if s.cfg.SourceIP == nil {
+		return nil
+	}
+	if strings.HasPrefix(network, "udp") {
+		return &net.UDPAddr{IP: s.cfg.SourceIP}
+	}
+	return &net.TCPAddr{IP: s.cfg.SourceIP}
+}
+
+// checkSourceIP makes sure cfg.SourceIP can be bound, so a wrong address
+// fails up front rather than on every query, and that without a proxy
+// every resolver can be reached from it.
+func checkSourceIP(cfg Config) error {
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(cfg.SourceIP.String(), "0"))
+	if err != nil {
+		return fmt.Errorf("can't send from source IP %s: %w", cfg.SourceIP, err)
+	}
+	conn.Close()
+
+	if cfg.Proxy != nil {
+		return nil
+	}
+	sourceV4 := cfg.SourceIP.To4() != nil
+	for _, resolver := range cfg.Resolvers {
+		ip := net.ParseIP(resolverHost(resolver))
+		if IsDoH(resolver) || ip == nil {
+			continue
+		}
+		if (ip.To4() != nil) != sourceV4 {
+			return fmt.Errorf("resolver %s is a different address family from source IP %s", resolver, cfg.SourceIP)
+		}
+	}
+	return nil
+}
+
+// dialProxy connects to resolverIP over TCP through Config.Proxy, with
+// the proxy handshake and any TLS handshake bounded by Config.Timeout.
+func (s *Scanner) dialProxy(ctx context.Context, resolverIP string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+
+	conn, err := s.proxy.DialContext(ctx, "tcp", s.resolverAddr(resolverIP))
+	if err != nil {
+		return nil, err
+	}
+	if s.cfg.Protocol != "dot" {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, s.tlsConfig(resolverIP))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// tlsConfig returns the TLS settings for a DNS-over-TLS connection to
+// resolverIP, verifying against Config.TLSServerName when it is set.
+func (s *Scanner) tlsConfig(resolverIP string) *tls.Config {
+	serverName := s.cfg.TLSServerName
+	if serverName == "" {
+		serverName = resolverHost(resolverIP)
+	}
+	return &tls.Config{ServerName: serverName}
+}
+
+// netResolver returns a net.Resolver that sends its queries to
+// resolverIP.
+func (s *Scanner) netResolver(resolverIP string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := s.dialResolver(ctx, network, resolverIP)
+			if err != nil {
+				return nil, err
+			}
+			// net.Resolver only passes ctx's deadline on to conn, so
+			// without this a cancelled query would still wait for its
+			// reply. ctx always ends once the lookup returns, by which
+			// time conn is closed and the deadline does nothing, or
+			// back in the pool with the deadline unregistered.
+			stop := context.AfterFunc(ctx, func() {
+				conn.SetDeadline(time.Now())
+			})
+			if pooled, ok := conn.(*pooledConn); ok {
+				pooled.stop = stop
+			}
+			return conn, nil
+		},
+	}
+}
+
+// lookupHost resolves hostname through r, or the DoH endpoint when
+// resolverIP is one.
+func (s *Scanner) lookupHost(ctx context.Context, r *net.Resolver, resolverIP, hostname string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+
+	if IsDoH(resolverIP) {
+		return s.dohLookupHost(ctx, resolverIP, hostname)
+	}
+	return r.LookupHost(ctx, hostname)
+}
+
+// forwardConfirm looks up hostname through r, or the DoH endpoint when
+// resolverIP is one, and reports whether any of the returned addresses
+// matches ip.
+func (s *Scanner) forwardConfirm(ctx context.Context, r *net.Resolver, resolverIP, hostname, ip string) bool {
+	addrs, err := s.lookupHost(ctx, r, resolverIP, hostname)
+	if err != nil {
+		return false
+	}
+
+	target := net.ParseIP(ip)
+	for _, a := range addrs {
+		if target.Equal(net.ParseIP(a)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package rdns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestResolverAddr(t *testing.T) {
+	tests := []struct {
+		resolver string
+		port     uint16
+		addr     string
+		host     string
+	}{
+		{"8.8.8.8", 53, "8.8.8.8:53", "8.8.8.8"},
+		{"8.8.8.8:5353", 53, "8.8.8.8:5353", "8.8.8.8"},
+		{"1.1.1.1", 853, "1.1.1.1:853", "1.1.1.1"},
+		{"2001:db8::1", 53, "[2001:db8::1]:53", "2001:db8::1"},
+		{"[2001:db8::1]:5353", 53, "[2001:db8::1]:5353", "2001:db8::1"},
+		{"::1", 853, "[::1]:853", "::1"},
+		{"fe80::1%eth0", 53, "[fe80::1%eth0]:53", "fe80::1%eth0"},
+		{"dns.example.com", 53, "dns.example.com:53", "dns.example.com"},
+	}
+
+	for _, tt := range tests {
+		s := &Scanner{cfg: Config{Port: tt.port}}
+		if addr := s.resolverAddr(tt.resolver); addr != tt.addr {
+			t.Errorf("resolverAddr(%q) with port %d = %q, want %q", tt.resolver, tt.port, addr, tt.addr)
+		}
+		if host := resolverHost(tt.resolver); host != tt.host {
+			t.Errorf("resolverHost(%q) = %q, want %q", tt.resolver, host, tt.host)
+		}
+	}
+}
+
+func TestResolveIPv6Resolver(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(ptrHandler)}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ActivateAndServe()
+	<-started
+	defer server.Shutdown()
+
+	// Given bare, so the port comes from Config.Port
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	for _, raw := range []bool{false, true} {
+		scanner := newTestScanner(t, Config{Resolvers: []string{"::1"}, Port: uint16(port), Timeout: time.Second, Raw: raw})
+		result, err := scanner.Resolve(context.Background(), "192.0.2.9")
+		if err != nil {
+			t.Errorf("raw=%v: %v", raw, err)
+			continue
+		}
+		if len(result.Hostnames) != 1 || result.Hostnames[0] != "host-9.example.com" {
+			t.Errorf("raw=%v: got %v, want [host-9.example.com]", raw, result.Hostnames)
+		}
+	}
+}
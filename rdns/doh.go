@@ -0,0 +1,102 @@
+package rdns
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// IsDoH reports whether a resolver entry is a DNS-over-HTTPS endpoint.
+func IsDoH(resolver string) bool {
+	return strings.HasPrefix(resolver, "https://")
+}
+
+// dohExchange POSTs m in wire format to the DoH endpoint at url and
+// returns the decoded response.
+func (s *Scanner) dohExchange(ctx context.Context, url string, m *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 recommends a zero ID so responses are cache friendly
+	m.Id = 0
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := s.doh.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server returned %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	in := new(dns.Msg)
+	if err := in.Unpack(body); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// dohLookupPTR resolves the PTR records for ip through the DoH endpoint
+// at url.
+func (s *Scanner) dohLookupPTR(ctx context.Context, url, ip string) (*ptrAnswer, error) {
+	arpa, err := dns.ReverseAddr(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	in, err := s.dohExchange(ctx, url, s.ptrQuery(arpa))
+	if err != nil {
+		return nil, err
+	}
+
+	return parsePTRResponse(in, arpa, url)
+}
+
+// dohLookupHost resolves the A and AAAA records for hostname through the
+// DoH endpoint at url.
+func (s *Scanner) dohLookupHost(ctx context.Context, url, hostname string) ([]string, error) {
+	var addrs []string
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(hostname), qtype)
+
+		in, err := s.dohExchange(ctx, url, m)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, rr := range in.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, rr.A.String())
+			case *dns.AAAA:
+				addrs = append(addrs, rr.AAAA.String())
+			}
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: hostname, Server: url, IsNotFound: true}
+	}
+	return addrs, nil
+}
@@ -0,0 +1,52 @@
+//go:build network
+
+package rdns
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// These tests query Cloudflare's public DNS-over-TLS resolver, so they
+// only run with go test -tags network.
+
+func TestDoTLookup(t *testing.T) {
+	for _, raw := range []bool{false, true} {
+		scanner, err := NewScanner(Config{
+			Resolvers:     []string{"1.1.1.1"},
+			Protocol:      "dot",
+			TLSServerName: "one.one.one.one",
+			Timeout:       5 * time.Second,
+			Raw:           raw,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := scanner.Resolve(context.Background(), "1.1.1.1")
+		if err != nil {
+			t.Errorf("raw=%v: %v", raw, err)
+			continue
+		}
+		if len(result.Hostnames) != 1 || result.Hostnames[0] != "one.one.one.one" {
+			t.Errorf("raw=%v: got %v, want [one.one.one.one]", raw, result.Hostnames)
+		}
+	}
+}
+
+func TestDoTWrongServerName(t *testing.T) {
+	scanner, err := NewScanner(Config{
+		Resolvers:     []string{"1.1.1.1"},
+		Protocol:      "dot",
+		TLSServerName: "dns.example.com",
+		Timeout:       5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := scanner.Resolve(context.Background(), "1.1.1.1"); err == nil {
+		t.Error("lookup succeeded against a certificate for another name")
+	}
+}
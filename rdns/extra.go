@@ -0,0 +1,88 @@
+package rdns
+
+import (
+	"context"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// extraRecords looks up every Config.ExtraTypes type for each of
+// hostnames on resolverIP. Each query gets Config.Timeout and up to
+// RetriesPerResolver retries, like a PTR query. Types a hostname has no
+// records of, and queries that keep failing, add nothing.
+func (s *Scanner) extraRecords(ctx context.Context, resolverIP string, hostnames []string) []Record {
+	var records []Record
+	for _, hostname := range hostnames {
+		for _, qtype := range s.cfg.ExtraTypes {
+			records = append(records, s.lookupExtra(ctx, resolverIP, hostname, qtype)...)
+		}
+	}
+	return records
+}
+
+// lookupExtra returns the qtype records for hostname from resolverIP.
+func (s *Scanner) lookupExtra(ctx context.Context, resolverIP, hostname string, qtype uint16) []Record {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(hostname), qtype)
+
+	for retry := 0; retry <= s.cfg.RetriesPerResolver; retry++ {
+		if ctx.Err() != nil {
+			return nil
+		}
+		in, err := s.exchange(ctx, resolverIP, m)
+		if err != nil {
+			continue
+		}
+		// Asking again won't make the name exist
+		if in.Rcode == dns.RcodeNameError {
+			return nil
+		}
+		if in.Rcode != dns.RcodeSuccess {
+			continue
+		}
+
+		var records []Record
+		for _, rr := range in.Answer {
+			if rr.Header().Rrtype != qtype {
+				continue
+			}
+			records = append(records, Record{
+				Name:  hostname,
+				Type:  dns.TypeToString[qtype],
+				Value: recordValue(rr),
+				TTL:   rr.Header().Ttl,
+			})
+		}
+		return records
+	}
+	return nil
+}
+
+// exchange sends m to resolverIP over DoH or raw DNS within
+// Config.Timeout, asking again over TCP if a UDP response is truncated.
+func (s *Scanner) exchange(ctx context.Context, resolverIP string, m *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+
+	if IsDoH(resolverIP) {
+		return s.dohExchange(ctx, resolverIP, m)
+	}
+
+	client := s.rawClient(resolverIP)
+	in, err := s.rawExchange(ctx, client, m, resolverIP)
+	if err == nil && in.Truncated && client.Net == "udp" {
+		client.Net = "tcp"
+		in, err = s.rawExchange(ctx, client, m, resolverIP)
+	}
+	return in, err
+}
+
+// recordValue returns the data of rr as it appears in a zone file, with
+// TXT strings joined and unquoted instead.
+func recordValue(rr dns.RR) string {
+	if txt, ok := rr.(*dns.TXT); ok {
+		return strings.Join(txt.Txt, "")
+	}
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
@@ -0,0 +1,92 @@
+package rdns
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// genericPatternSources match the templated hostnames ISPs and cloud
+// providers hand out for whole address blocks.
+var genericPatternSources = []string{
+	`(?i)(^|[.-])(dhcp|dyn|dynamic|pool|static|dsl|adsl|vdsl|cable|ppp|pppoe|broadband|dialup|client|customer|cpe|host|ip|unassigned)[.-]?\d`,
+	`(?i)^ec2-\d+-\d+-\d+-\d+\.`,
+	`(?i)^ip-\d+-\d+-\d+-\d+\.`,
+	`(?i)\.(static|dynamic|dyn|pool|dsl|cable|res|rev|ptr)\.`,
+}
+
+// defaultGenericPatterns compiles the built-in generic hostname patterns.
+func defaultGenericPatterns() []*regexp.Regexp {
+	patterns := make([]*regexp.Regexp, len(genericPatternSources))
+	for i, source := range genericPatternSources {
+		patterns[i] = regexp.MustCompile(source)
+	}
+	return patterns
+}
+
+// isGenericHostname reports whether hostname looks like a placeholder PTR
+// for ip, either because it embeds the address itself or because it matches
+// one of the generic patterns.
+func isGenericHostname(hostname, ip string, patterns []*regexp.Regexp) bool {
+	if embedsIP(hostname, ip) {
+		return true
+	}
+	for _, re := range patterns {
+		if re.MatchString(hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// embedsIP reports whether hostname contains the octets of an IPv4 address,
+// in either order, joined by dots, dashes or nothing at all.
+func embedsIP(hostname, ip string) bool {
+	v4 := net.ParseIP(ip).To4()
+	if v4 == nil {
+		return false
+	}
+
+	octets := make([]string, 4)
+	for i, b := range v4 {
+		octets[i] = fmt.Sprint(b)
+	}
+	reversed := []string{octets[3], octets[2], octets[1], octets[0]}
+
+	hostname = strings.ToLower(hostname)
+	for _, parts := range [][]string{octets, reversed} {
+		for _, sep := range []string{"-", ".", "_", ""} {
+			if strings.Contains(hostname, strings.Join(parts, sep)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsGeneric reports whether hostname looks like a placeholder PTR for ip,
+// by the same rules as Config.SkipGeneric.
+func (s *Scanner) IsGeneric(hostname, ip string) bool {
+	return isGenericHostname(hostname, ip, s.generic)
+}
+
+// filterGeneric removes generic hostnames from answer, counting each one
+// it drops.
+func (s *Scanner) filterGeneric(answer *ptrAnswer, ip string) {
+	kept := answer.hostnames[:0]
+	var ttls []uint32
+	for i, hostname := range answer.hostnames {
+		if isGenericHostname(hostname, ip, s.generic) {
+			atomic.AddInt64(&s.stats.Generic, 1)
+			continue
+		}
+		kept = append(kept, hostname)
+		if answer.ttls != nil {
+			ttls = append(ttls, answer.ttls[i])
+		}
+	}
+	answer.hostnames = kept
+	answer.ttls = ttls
+}
@@ -0,0 +1,89 @@
+package rdns
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// resolverHealth tracks consecutive failures per resolver so that ones which
+// keep failing are taken out of rotation for a cooldown. A nil
+// *resolverHealth treats every resolver as healthy.
+type resolverHealth struct {
+	mu         sync.Mutex
+	total      int
+	ejectAfter int
+	cooldown   time.Duration
+	logger     *slog.Logger
+	failures   map[string]int
+	ejectedAt  map[string]time.Time
+}
+
+func newResolverHealth(resolvers []string, ejectAfter int, cooldown time.Duration, logger *slog.Logger) *resolverHealth {
+	unique := make(map[string]bool, len(resolvers))
+	for _, resolver := range resolvers {
+		unique[resolver] = true
+	}
+
+	return &resolverHealth{
+		total:      len(unique),
+		ejectAfter: ejectAfter,
+		cooldown:   cooldown,
+		logger:     logger,
+		failures:   make(map[string]int),
+		ejectedAt:  make(map[string]time.Time),
+	}
+}
+
+// usable reports whether resolver should be queried. Resolvers whose
+// cooldown has passed are restored. If every resolver is ejected they are
+// all used anyway rather than failing every IP.
+func (h *resolverHealth) usable(resolver string) bool {
+	if h == nil {
+		return true
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	at, ejected := h.ejectedAt[resolver]
+	if !ejected {
+		return true
+	}
+
+	if time.Since(at) >= h.cooldown {
+		delete(h.ejectedAt, resolver)
+		h.failures[resolver] = 0
+		h.logger.Info("Resolver restored after cooldown", "resolver", resolver)
+		return true
+	}
+
+	return len(h.ejectedAt) >= h.total
+}
+
+// record notes the outcome of a query to resolver. Answers saying that no
+// PTR exists still count as the resolver working.
+func (h *resolverHealth) record(resolver string, err error) {
+	if h == nil {
+		return
+	}
+
+	var dnsErr *net.DNSError
+	healthy := err == nil || (errors.As(err, &dnsErr) && dnsErr.IsNotFound)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if healthy {
+		h.failures[resolver] = 0
+		return
+	}
+
+	h.failures[resolver]++
+	if _, ejected := h.ejectedAt[resolver]; !ejected && h.failures[resolver] >= h.ejectAfter {
+		h.ejectedAt[resolver] = time.Now()
+		h.logger.Info("Resolver ejected", "resolver", resolver, "failures", h.failures[resolver])
+	}
+}
@@ -0,0 +1,138 @@
+package rdns
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// poolIdleTimeout is how long a connection may sit in a connPool before
+// it is closed instead of reused. Servers commonly drop idle TCP clients
+// after about ten seconds.
+const poolIdleTimeout = 5 * time.Second
+
+// connPool keeps idle TCP and DNS-over-TLS connections to each resolver
+// for Config.ConnPoolSize, so queries can share them rather than each
+// paying for a new handshake, and UDP sockets for Config.UDPSockets. A
+// connection is only used by one query at a time.
+type connPool struct {
+	size int
+	// stream pools check a connection is still open before reusing it.
+	// A UDP socket has no peer to close it, and a late reply to an
+	// earlier query is skipped by its ID rather than read here.
+	stream bool
+	mu     sync.Mutex
+	idle   map[string][]idleConn
+}
+
+// idleConn is a connection waiting in a connPool since it was last used.
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+func newConnPool(size int, stream bool) *connPool {
+	return &connPool{size: size, stream: stream, idle: make(map[string][]idleConn)}
+}
+
+// get returns an idle connection to resolverIP, the most recently used
+// first, or nil if there is none the server still has open.
+func (p *connPool) get(resolverIP string) net.Conn {
+	for {
+		p.mu.Lock()
+		conns := p.idle[resolverIP]
+		if len(conns) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		c := conns[len(conns)-1]
+		p.idle[resolverIP] = conns[:len(conns)-1]
+		p.mu.Unlock()
+
+		if time.Since(c.since) < poolIdleTimeout && (!p.stream || !closedByPeer(c.conn)) {
+			return c.conn
+		}
+		c.conn.Close()
+	}
+}
+
+// put returns conn to the pool after a query that went through cleanly,
+// closing it instead if resolverIP already has enough idle connections.
+func (p *connPool) put(resolverIP string, conn net.Conn) {
+	conn.SetDeadline(time.Time{})
+
+	p.mu.Lock()
+	if len(p.idle[resolverIP]) < p.size {
+		p.idle[resolverIP] = append(p.idle[resolverIP], idleConn{conn: conn, since: time.Now()})
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+	conn.Close()
+}
+
+// closeIdle closes every idle connection in the pool.
+func (p *connPool) closeIdle() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = make(map[string][]idleConn)
+	p.mu.Unlock()
+
+	for _, conns := range idle {
+		for _, c := range conns {
+			c.conn.Close()
+		}
+	}
+}
+
+// closedByPeer reports whether conn can't be used for another query,
+// because the server closed it while it was idle or sent something no
+// query is waiting for. A live connection has nothing to read, so a read
+// that all but times out straight away is enough to tell.
+func closedByPeer(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	conn.SetReadDeadline(time.Time{})
+
+	var netErr net.Error
+	return !errors.As(err, &netErr) || !netErr.Timeout()
+}
+
+// pooledConn is a connection from net.Resolver's Dial that goes back to
+// the pool when the resolver closes it, unless a read or write failed or
+// the query was cancelled, which may leave a reply still to come.
+type pooledConn struct {
+	net.Conn
+	pool       *connPool
+	resolverIP string
+	// stop unregisters the deadline set when the query's context ends.
+	// It returns false if that has already happened.
+	stop   func() bool
+	broken bool
+}
+
+func (c *pooledConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		c.broken = true
+	}
+	return n, err
+}
+
+func (c *pooledConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		c.broken = true
+	}
+	return n, err
+}
+
+func (c *pooledConn) Close() error {
+	if c.broken || (c.stop != nil && !c.stop()) {
+		return c.Conn.Close()
+	}
+	c.pool.put(c.resolverIP, c.Conn)
+	return nil
+}
@@ -0,0 +1,34 @@
+package rdns
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCloseIdleConns(t *testing.T) {
+	resolver := startServer(t, ptrHandler)
+	scanner := newTestScanner(t, Config{Resolvers: []string{resolver}, Protocol: "tcp", ConnPoolSize: 2, Timeout: time.Second})
+
+	if _, err := scanner.Resolve(context.Background(), "192.0.2.3"); err != nil {
+		t.Fatal(err)
+	}
+	conn := scanner.pool.get(resolver)
+	if conn == nil {
+		t.Fatal("no connection was kept for reuse")
+	}
+	scanner.pool.put(resolver, conn)
+
+	scanner.Close()
+	if scanner.pool.get(resolver) != nil {
+		t.Error("pool still holds a connection after Close")
+	}
+	if _, err := conn.Write([]byte{0}); err == nil {
+		t.Error("connection still open after Close")
+	}
+
+	// New connections are opened as needed
+	if _, err := scanner.Resolve(context.Background(), "192.0.2.4"); err != nil {
+		t.Errorf("lookup after Close: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package rdns
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// resolverAnswer is what one resolver said about an IP under
+// Config.QueryAll: its PTR records, or err when it had none.
+type resolverAnswer struct {
+	idx    int
+	r      *net.Resolver
+	answer *ptrAnswer
+	err    error
+}
+
+// mergeAnswers builds the Result for ip from the answers of every
+// resolver that gave one, with the hostnames of all of them, each listed
+// once, and the first resolver with PTR records as the Result's Resolver.
+// Each resolver's own answer goes in Result.Answers when they differ. The
+// IP fails with NXDOMAIN if no resolver had any, or with lastErr if none
+// answered at all.
+func (s *Scanner) mergeAnswers(ctx, ipCtx context.Context, ip string, answers []resolverAnswer, lastErr error) Result {
+	disagree := s.disagree(answers)
+	if disagree {
+		atomic.AddInt64(&s.stats.Disagreements, 1)
+		s.cfg.Logger.Info("Resolvers disagree", "ip", ip, "answers", s.describeAnswers(answers))
+	}
+
+	var first *resolverAnswer
+	merged := &ptrAnswer{}
+	// TTLs are only kept if every resolver's answer had them, so they
+	// still line up with the hostnames
+	withTTLs := true
+	seen := make(map[string]bool)
+	seenNS := make(map[string]bool)
+	for i, a := range answers {
+		if a.answer == nil {
+			continue
+		}
+		if first == nil {
+			first = &answers[i]
+		}
+		withTTLs = withTTLs && a.answer.ttls != nil
+		for j, hostname := range a.answer.hostnames {
+			if seen[strings.ToLower(hostname)] {
+				continue
+			}
+			seen[strings.ToLower(hostname)] = true
+			merged.hostnames = append(merged.hostnames, hostname)
+			if a.answer.ttls != nil {
+				merged.ttls = append(merged.ttls, a.answer.ttls[j])
+			}
+		}
+		for _, ns := range a.answer.authority {
+			if !seenNS[strings.ToLower(ns)] {
+				seenNS[strings.ToLower(ns)] = true
+				merged.authority = append(merged.authority, ns)
+			}
+		}
+		merged.truncated = merged.truncated || a.answer.truncated
+	}
+
+	if first == nil {
+		if len(answers) > 0 {
+			return s.failed(ip, answers[0].err)
+		}
+		return s.failed(ip, lastErr)
+	}
+	if !withTTLs {
+		merged.ttls = nil
+	}
+	result := s.resolved(ctx, ipCtx, ip, s.cfg.Resolvers[first.idx], first.r, merged)
+	if disagree && !result.Skipped {
+		for _, a := range answers {
+			answer := Answer{Resolver: s.cfg.Resolvers[a.idx]}
+			if a.answer != nil {
+				answer.Hostnames = a.answer.hostnames
+			}
+			result.Answers = append(result.Answers, answer)
+		}
+	}
+	return result
+}
+
+// disagree reports whether the resolvers in answers didn't all return the
+// same hostnames, counting no PTR records as an answer of its own.
+func (s *Scanner) disagree(answers []resolverAnswer) bool {
+	for i := 1; i < len(answers); i++ {
+		if answerKey(answers[i]) != answerKey(answers[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// answerKey returns the hostnames in a, lowercased and sorted, so answers
+// listing the same names in another order or case compare equal.
+func answerKey(a resolverAnswer) string {
+	if a.answer == nil {
+		return ""
+	}
+	key := make([]string, len(a.answer.hostnames))
+	for i, hostname := range a.answer.hostnames {
+		key[i] = strings.ToLower(hostname)
+	}
+	sort.Strings(key)
+	return strings.Join(key, ",")
+}
+
+// describeAnswers lists each resolver's answer for a log message, such as
+// "1.1.1.1=a.example.com,b.example.com 8.8.8.8=NXDOMAIN".
+func (s *Scanner) describeAnswers(answers []resolverAnswer) string {
+	parts := make([]string, len(answers))
+	for i, a := range answers {
+		text := "NXDOMAIN"
+		if a.answer != nil {
+			text = strings.Join(a.answer.hostnames, ",")
+		}
+		parts[i] = s.cfg.Resolvers[a.idx] + "=" + text
+	}
+	return strings.Join(parts, " ")
+}
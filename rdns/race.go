@@ -0,0 +1,145 @@
+package rdns
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// raceAttempt is the outcome of one resolver's query in a race.
+type raceAttempt struct {
+	idx     int
+	r       *net.Resolver
+	answer  *ptrAnswer
+	err     error
+	elapsed time.Duration
+	// sent is false when the race was over, or MaxQueries reached,
+	// before the query went out.
+	sent bool
+}
+
+// race looks up ip on Config.RaceResolvers resolvers at once, taking the
+// first answer with PTR records and cancelling the rest. Groups of that
+// many resolvers, taken from candidates in order, are raced one after
+// another until one answers, a resolver reports NXDOMAIN, or every
+// resolver has been tried RetriesPerResolver+1 times.
+func (s *Scanner) race(ctx, ipCtx context.Context, ip string, candidates []int) Result {
+	width := s.cfg.RaceResolvers
+	var lastErr error
+	for round := 0; round <= s.cfg.RetriesPerResolver; round++ {
+		for start := 0; start < len(candidates); start += width {
+			if ctx.Err() != nil {
+				return Result{IP: ip, Skipped: true}
+			}
+			if ipCtx.Err() != nil {
+				return s.failed(ip, ErrPerIPTimeout)
+			}
+
+			group := candidates[start:min(start+width, len(candidates))]
+			winner, err, capped := s.raceGroup(ctx, ipCtx, ip, group)
+			if ctx.Err() != nil {
+				return Result{IP: ip, Skipped: true}
+			}
+			if winner != nil {
+				return s.resolved(ctx, ipCtx, ip, s.cfg.Resolvers[winner.idx], winner.r, winner.answer)
+			}
+			if capped {
+				return Result{IP: ip, Skipped: true}
+			}
+			if err != nil {
+				lastErr = err
+			}
+
+			// Asking again won't make a PTR appear
+			if lastErr != nil && Classify(lastErr) == StatusNXDomain {
+				return s.failed(ip, lastErr)
+			}
+		}
+	}
+	return s.failed(ip, lastErr)
+}
+
+// raceGroup queries ip on every resolver in group at once and returns the
+// first attempt to come back with PTR records, if any. Otherwise it
+// returns the last error, and capped is set if MaxQueries stopped every
+// query from being sent. Only the winner is counted against its
+// resolver, or when nobody wins the attempt that gave the last error,
+// and nothing is counted once ctx is done.
+//
+// The losers are cancelled but not waited for, since a Config.Raw query
+// only gives up at its deadline. Their results go into a buffered
+// channel, so they finish within Config.Timeout rather than leaking.
+func (s *Scanner) raceGroup(ctx, ipCtx context.Context, ip string, group []int) (winner *raceAttempt, lastErr error, capped bool) {
+	raceCtx, cancel := context.WithCancel(ipCtx)
+	defer cancel()
+
+	attempts := make(chan raceAttempt, len(group))
+	for _, idx := range group {
+		go func() {
+			attempts <- s.raceQuery(raceCtx, ip, idx)
+		}()
+	}
+
+	sent := 0
+	var last raceAttempt
+	for range group {
+		attempt := <-attempts
+		if !attempt.sent {
+			continue
+		}
+		sent++
+		if ctx.Err() != nil {
+			return nil, ctx.Err(), false
+		}
+
+		err := attempt.err
+		if err == nil && len(attempt.answer.hostnames) == 0 {
+			err = ErrNoPTR
+		}
+		if err == nil {
+			s.recordAttempt(attempt.idx, ip, attempt.err, attempt.elapsed)
+			return &attempt, nil, false
+		}
+		last, lastErr = attempt, err
+	}
+
+	if sent > 0 {
+		s.recordAttempt(last.idx, ip, last.err, last.elapsed)
+	}
+	return nil, lastErr, sent == 0 && s.queryCapHit()
+}
+
+// raceQuery sends one query in a race, waiting on the resolver's rate
+// limit and in-flight cap first. It gives up without sending if raceCtx
+// ends while waiting.
+func (s *Scanner) raceQuery(raceCtx context.Context, ip string, idx int) raceAttempt {
+	resolverIP := s.cfg.Resolvers[idx]
+	attempt := raceAttempt{idx: idx}
+
+	if limiter := s.limiters[resolverIP]; limiter != nil {
+		if s.waitLimiter(raceCtx, limiter) != nil {
+			return attempt
+		}
+	}
+	if slots := s.inflight[resolverIP]; slots != nil {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		case <-raceCtx.Done():
+			return attempt
+		}
+	}
+	if raceCtx.Err() != nil || !s.takeQuery() {
+		return attempt
+	}
+
+	ctx, cancel := context.WithTimeout(raceCtx, s.queryTimeout(ip))
+	defer cancel()
+
+	attempt.sent = true
+	attempt.r = s.netResolver(resolverIP)
+	sent := time.Now()
+	attempt.answer, attempt.err = s.lookupPTR(ctx, attempt.r, resolverIP, ip)
+	attempt.elapsed = time.Since(sent)
+	return attempt
+}
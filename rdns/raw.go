@@ -0,0 +1,183 @@
+package rdns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rawLookupPTR sends a PTR query for ip straight to resolverIP, bypassing
+// net.Resolver so the TTLs, authority section and truncation flag of the
+// response are available. Truncated UDP responses are retried over TCP.
+func (s *Scanner) rawLookupPTR(ctx context.Context, resolverIP, ip string) (*ptrAnswer, error) {
+	arpa, err := dns.ReverseAddr(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	m := s.ptrQuery(arpa)
+	client := s.rawClient(resolverIP)
+	client.Timeout = s.queryTimeout(ip)
+
+	server := s.resolverAddr(resolverIP)
+	in, err := s.rawExchange(ctx, client, m, resolverIP)
+	if err != nil {
+		return nil, err
+	}
+
+	// A UDP response that didn't fit is missing records, so ask again
+	// over TCP rather than report a partial answer
+	truncated := in.Truncated
+	if truncated && client.Net == "udp" {
+		atomic.AddInt64(&s.stats.Truncated, 1)
+		client.Net = "tcp"
+		in, err = s.rawExchange(ctx, client, m, resolverIP)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	answer, err := parsePTRResponse(in, arpa, server)
+	if answer != nil && truncated {
+		// Still flag it, the records are complete but came over TCP
+		answer.truncated = true
+	}
+	return answer, err
+}
+
+// rawClient returns a client for raw queries to resolverIP over the
+// configured protocol.
+func (s *Scanner) rawClient(resolverIP string) *dns.Client {
+	client := &dns.Client{
+		Net:     s.cfg.Protocol,
+		Timeout: s.cfg.Timeout,
+	}
+	if s.cfg.Protocol == "dot" {
+		client.Net = "tcp-tls"
+		client.TLSConfig = s.tlsConfig(resolverIP)
+	}
+	return client
+}
+
+// rawExchange sends m to resolverIP with client, through Config.Proxy
+// when one is set. The proxy is always TCP, so its responses are never
+// truncated. client only goes by ctx's deadline, so the connection's
+// deadline is brought forward if ctx is cancelled. TCP and DNS-over-TLS
+// connections are shared through the pool when Config.ConnPoolSize is
+// set, and UDP sockets when Config.UDPSockets is.
+func (s *Scanner) rawExchange(ctx context.Context, client *dns.Client, m *dns.Msg, resolverIP string) (*dns.Msg, error) {
+	pool := s.pool
+	if client.Net == "udp" {
+		pool = s.udpPool
+	}
+
+	var co *dns.Conn
+	if pool != nil {
+		if conn := pool.get(resolverIP); conn != nil {
+			co = &dns.Conn{Conn: conn}
+		}
+	}
+
+	if co == nil {
+		var err error
+		if co, err = s.rawDial(ctx, client, resolverIP); err != nil {
+			return nil, err
+		}
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		co.SetDeadline(time.Now())
+	})
+
+	in, _, err := client.ExchangeWithConnContext(ctx, m, co)
+	if stop() && pool != nil && err == nil {
+		pool.put(resolverIP, co.Conn)
+	} else {
+		co.Close()
+	}
+	return in, err
+}
+
+// rawDial opens a new connection to resolverIP for rawExchange.
+func (s *Scanner) rawDial(ctx context.Context, client *dns.Client, resolverIP string) (*dns.Conn, error) {
+	if s.proxy != nil {
+		conn, err := s.dialProxy(ctx, resolverIP)
+		if err != nil {
+			return nil, err
+		}
+		return &dns.Conn{Conn: conn}, nil
+	}
+	client.Dialer = &net.Dialer{Timeout: client.Timeout, LocalAddr: s.localAddr(client.Net)}
+	return client.DialContext(ctx, s.resolverAddr(resolverIP))
+}
+
+// ptrQuery builds the PTR query for arpa, carrying Config.ECS when set
+// and with the flags Config.NoRecursion and Config.DNSSEC ask for.
+func (s *Scanner) ptrQuery(arpa string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(arpa, dns.TypePTR)
+	m.RecursionDesired = !s.cfg.NoRecursion
+
+	if s.cfg.DNSSEC {
+		m.AuthenticatedData = true
+		m.CheckingDisabled = true
+		m.SetEdns0(dns.DefaultMsgSize, true)
+	}
+
+	if s.cfg.ECS != nil {
+		ones, _ := s.cfg.ECS.Mask.Size()
+		subnet := &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: uint8(ones),
+			Address:       s.cfg.ECS.IP,
+		}
+		if s.cfg.ECS.IP.To4() == nil {
+			subnet.Family = 2
+		}
+		if m.IsEdns0() == nil {
+			m.SetEdns0(dns.DefaultMsgSize, false)
+		}
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, subnet)
+	}
+
+	return m
+}
+
+// parsePTRResponse turns a PTR response into a ptrAnswer, mapping error
+// rcodes onto *net.DNSError like net.Resolver does.
+func parsePTRResponse(in *dns.Msg, arpa, server string) (*ptrAnswer, error) {
+	switch in.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		return nil, &net.DNSError{Err: "no such host", Name: arpa, Server: server, IsNotFound: true}
+	case dns.RcodeServerFailure:
+		return nil, &net.DNSError{Err: "server returned SERVFAIL", Name: arpa, Server: server, IsTemporary: true}
+	default:
+		return nil, &net.DNSError{Err: fmt.Sprintf("server returned %s", dns.RcodeToString[in.Rcode]), Name: arpa, Server: server}
+	}
+
+	answer := &ptrAnswer{truncated: in.Truncated}
+	for _, rr := range in.Answer {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			answer.hostnames = append(answer.hostnames, strings.TrimRight(ptr.Ptr, "."))
+			answer.ttls = append(answer.ttls, ptr.Hdr.Ttl)
+		}
+	}
+	for _, rr := range in.Ns {
+		switch rr := rr.(type) {
+		case *dns.NS:
+			answer.authority = append(answer.authority, strings.TrimRight(rr.Ns, "."))
+		case *dns.SOA:
+			answer.authority = append(answer.authority, strings.TrimRight(rr.Ns, "."))
+		}
+	}
+
+	return answer, nil
+}
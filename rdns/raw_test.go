@@ -0,0 +1,71 @@
+package rdns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// truncatingHandler answers PTR queries with 20 hostnames over TCP, but
+// only with the TC bit set over UDP.
+func truncatingHandler(w dns.ResponseWriter, req *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		resp.Truncated = true
+		w.WriteMsg(resp)
+		return
+	}
+
+	for i := 0; i < 20; i++ {
+		resp.Answer = append(resp.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 60},
+			Ptr: fmt.Sprintf("host-%d.example.com.", i),
+		})
+	}
+	w.WriteMsg(resp)
+}
+
+func TestRawTruncated(t *testing.T) {
+	resolver := startServer(t, truncatingHandler)
+	scanner := newTestScanner(t, Config{Resolvers: []string{resolver}, Timeout: time.Second, Raw: true})
+
+	result, err := scanner.Resolve(context.Background(), "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Hostnames) != 20 || len(result.TTLs) != 20 {
+		t.Fatalf("got %d hostnames and %d TTLs, want 20 of each", len(result.Hostnames), len(result.TTLs))
+	}
+	for i, hostname := range result.Hostnames {
+		if want := fmt.Sprintf("host-%d.example.com", i); hostname != want || result.TTLs[i] != 60 {
+			t.Errorf("record %d: got %s with TTL %d, want %s with TTL 60", i, hostname, result.TTLs[i], want)
+		}
+	}
+	if !result.Truncated {
+		t.Error("result not flagged as truncated")
+	}
+	if truncated := scanner.Stats().Truncated; truncated != 1 {
+		t.Errorf("counted %d truncated responses, want 1", truncated)
+	}
+}
+
+func TestRawNotTruncated(t *testing.T) {
+	resolver := startServer(t, ptrHandler)
+	scanner := newTestScanner(t, Config{Resolvers: []string{resolver}, Timeout: time.Second, Raw: true})
+
+	result, err := scanner.Resolve(context.Background(), "192.0.2.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Truncated || scanner.Stats().Truncated != 0 {
+		t.Errorf("untruncated answer flagged as truncated: %+v", result)
+	}
+	if len(result.TTLs) != 1 || result.TTLs[0] != 300 {
+		t.Errorf("got TTLs %v, want [300]", result.TTLs)
+	}
+}
@@ -0,0 +1,127 @@
+package rdns
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Result is the outcome of looking up one IP.
+type Result struct {
+	IP string
+	// Hostnames are the PTR records found, without trailing dots.
+	Hostnames []string
+	// TTLs, Authority and Truncated are only filled in with Config.Raw.
+	// TTLs is indexed like Hostnames. Truncated UDP responses are queried
+	// again over TCP, so the records are complete even when it is set.
+	TTLs      []uint32
+	Authority []string
+	Truncated bool
+	// Verified is only set with Config.Validate, and is indexed like
+	// Hostnames.
+	Verified []bool
+	// Dropped is how many more hostnames there were than
+	// Config.MaxHostnames allows.
+	Dropped int
+	// Records are the Config.ExtraTypes records found for Hostnames.
+	Records []Record
+	// Resolver is the resolver that answered.
+	Resolver string
+	// Err is why the IP failed on every resolver.
+	Err error
+	// Skipped is set for IPs that were never looked up because the run
+	// was stopped early.
+	Skipped bool
+	// Comment is copied from the Target the IP came from.
+	Comment string
+	// Answers is what each resolver returned, in the order they answered,
+	// when Config.QueryAll is set and they didn't all agree.
+	Answers []Answer
+}
+
+// Answer is one resolver's answer for an IP under Config.QueryAll.
+type Answer struct {
+	Resolver string
+	// Hostnames are its PTR records, and are empty when it had none.
+	Hostnames []string
+}
+
+// Target is an IP for Run to look up.
+type Target struct {
+	IP string
+	// Comment is any annotation the caller wants carried through to the
+	// Result. It isn't used for the lookup.
+	Comment string
+}
+
+// Record is one answer to a Config.ExtraTypes query for a hostname.
+type Record struct {
+	// Name is the hostname that was asked about, even when the answer
+	// came through a CNAME.
+	Name string `json:"name"`
+	// Type is the record type, such as "A" or "TXT".
+	Type string `json:"type"`
+	// Value is the record data in zone file form, except that TXT
+	// strings are joined without quotes.
+	Value string `json:"value"`
+	TTL   uint32 `json:"ttl"`
+}
+
+// ErrPerIPTimeout is reported for IPs abandoned because of
+// Config.PerIPTimeout.
+var ErrPerIPTimeout = errors.New("per-IP timeout exceeded")
+
+// ErrNoPTR is reported when a lookup succeeds without any PTR records.
+var ErrNoPTR = errors.New("no PTR records returned")
+
+// ErrMaxQueries is returned by Resolve once Config.MaxQueries is reached.
+var ErrMaxQueries = errors.New("maximum queries reached")
+
+// Failure categories reported by Classify.
+const (
+	StatusNXDomain = "nxdomain"
+	StatusServFail = "servfail"
+	StatusTimeout  = "timeout"
+	StatusError    = "error"
+)
+
+// Classify sorts a lookup error into one of the failure categories.
+// NXDOMAIN and empty answers mean no PTR exists, while SERVFAIL and
+// timeouts point at a resolver problem worth retrying elsewhere.
+func Classify(err error) string {
+	if errors.Is(err, ErrNoPTR) {
+		return StatusNXDomain
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		switch {
+		case dnsErr.IsNotFound:
+			return StatusNXDomain
+		case dnsErr.IsTimeout:
+			return StatusTimeout
+		case dnsErr.IsTemporary && (dnsErr.Err == "server misbehaving" || dnsErr.Err == "server returned SERVFAIL"):
+			// net.Resolver reports SERVFAIL as "server misbehaving" but
+			// also marks connection failures temporary, so check the text
+			return StatusServFail
+		}
+	}
+
+	var netErr net.Error
+	if errors.Is(err, ErrPerIPTimeout) || errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) {
+		return StatusTimeout
+	}
+
+	return StatusError
+}
+
+// ptrAnswer holds the hostnames returned by a single PTR lookup, without
+// their trailing dots. The TTLs, authority and truncation flag are only
+// filled in by the raw backend.
+type ptrAnswer struct {
+	hostnames []string
+	ttls      []uint32
+	authority []string
+	truncated bool
+}
@@ -0,0 +1,985 @@
+// Package rdns performs bulk reverse DNS (PTR) lookups across a pool of
+// resolvers, with the retries, rate limits and resolver health tracking
+// used by the rdns command.
+//
+//	scanner, err := rdns.NewScanner(rdns.Config{Resolvers: []string{"1.1.1.1", "8.8.8.8"}})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	result, err := scanner.Resolve(ctx, "8.8.8.8")
+package rdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+	"golang.org/x/time/rate"
+)
+
+// Config controls how a Scanner looks up PTR records. Only Resolvers is
+// required, NewScanner fills in defaults for the rest.
+type Config struct {
+	// Resolvers are the servers queried, each a bare IP, host:port,
+	// [ipv6]:port or a DNS-over-HTTPS URL starting with https://.
+	Resolvers []string
+	// Weights gives resolvers a bigger share of the lookups: one with
+	// weight 3 is asked first three times as often as one with weight 1.
+	// Resolvers missing from it have weight 1.
+	Weights map[string]int
+
+	// Protocol is "udp" (the default), "tcp" or "dot" for DNS-over-TLS.
+	Protocol string
+	// Port is used for resolvers given without one. It defaults to 53,
+	// or 853 for DNS-over-TLS.
+	Port uint16
+	// TLSServerName is the name DNS-over-TLS certificates are verified
+	// against. By default it is the resolver's own address.
+	TLSServerName string
+
+	// Timeout bounds each query. It defaults to 2 seconds.
+	Timeout time.Duration
+	// Timeout6, when set, bounds PTR queries for IPv6 addresses instead
+	// of Timeout, since their reverse zones often take more delegations
+	// to reach.
+	Timeout6 time.Duration
+	// RetriesPerResolver is how many more times a failed query is sent
+	// to each resolver.
+	RetriesPerResolver int
+	// MaxResolvers is how many resolvers an IP is tried on before it
+	// fails. Zero tries every resolver.
+	MaxResolvers int
+	// RetryStrategy is "same-first" (the default), which spends the
+	// retries on each resolver before moving on, or "rotate-first",
+	// which moves on straight away and retries in later passes.
+	RetryStrategy string
+	// RaceResolvers, when above 1, sends each query to this many
+	// resolvers at once and takes the first answer with PTR records,
+	// cancelling the others. Resolvers are raced a group at a time in
+	// the usual order, and RetryStrategy doesn't apply.
+	RaceResolvers int
+	// QueryAll asks every resolver about each IP, rather than stopping at
+	// the first with PTR records, and merges the hostnames they return.
+	// Resolvers that give different answers are logged at info level.
+	// It can't be combined with RaceResolvers.
+	QueryAll bool
+	// PerIPTimeout bounds all attempts for one IP together. Zero means
+	// no limit.
+	PerIPTimeout time.Duration
+
+	// Raw sends PTR queries directly instead of through net.Resolver, so
+	// results carry TTLs, the authority section and truncation.
+	Raw bool
+	// ECS is sent with every PTR query as an EDNS0 Client Subnet option,
+	// for servers whose answers depend on where the client is. It needs
+	// Raw, since net.Resolver can't add EDNS0 options.
+	ECS *net.IPNet
+	// NoRecursion clears the RD bit on PTR queries, for resolvers that
+	// are really the authoritative servers for the addresses. Like ECS,
+	// it needs Raw.
+	NoRecursion bool
+	// DNSSEC sets the DO bit in an EDNS0 record on PTR queries, along
+	// with AD and CD, so signatures come back even when they don't
+	// validate. It needs Raw.
+	DNSSEC bool
+
+	// ExtraTypes are record types, such as dns.TypeA, looked up for every
+	// hostname found, on the resolver that returned it. The answers go
+	// in Result.Records. Like ECS, it needs Raw.
+	ExtraTypes []uint16
+
+	// Proxy, when set, is a socks5://host:port URL to send every lookup
+	// through. SOCKS5 only carries TCP, so Protocol can't be "udp".
+	Proxy *url.URL
+	// SourceIP, when set, is the local address every query is sent from,
+	// for machines with more than one. It must be assigned to the
+	// machine and, without a Proxy, be the same address family as the
+	// resolvers.
+	SourceIP net.IP
+	// Validate forward-confirms every hostname, filling in
+	// Result.Verified.
+	Validate bool
+	// SkipGeneric drops placeholder hostnames such as
+	// 1-2-3-4.static.example.com from results.
+	SkipGeneric bool
+	// GenericPatterns replaces the built-in patterns SkipGeneric and
+	// IsGeneric use.
+	GenericPatterns []*regexp.Regexp
+	// MaxHostnames keeps only the first this many hostnames of an IP,
+	// after any generic ones are dropped. Zero keeps them all.
+	MaxHostnames int
+
+	// Workers is how many lookups Run does at once. It defaults to 100.
+	Workers int
+	// ShuffleResolvers gives each of Run's workers its own random
+	// resolver order instead of rotating through the list.
+	ShuffleResolvers bool
+	// Seed seeds ShuffleResolvers. Zero seeds from the clock.
+	Seed int64
+	// GroupBy24 starts every address in a /24 on the same resolver.
+	GroupBy24 bool
+
+	// EjectAfter takes a resolver out of rotation for EjectCooldown after
+	// this many consecutive failures. Zero never ejects.
+	EjectAfter    int
+	EjectCooldown time.Duration
+
+	// RateLimit is the queries per second allowed to each resolver,
+	// MaxInflight the queries outstanding to each resolver at once and
+	// GlobalRate the IPs per second looked up overall. Zero means no
+	// limit for each of them.
+	RateLimit   int
+	MaxInflight int
+	GlobalRate  int
+	// ConnPoolSize is how many idle TCP and DNS-over-TLS connections are
+	// kept to each resolver for later queries to reuse. Zero opens a new
+	// connection for every query.
+	ConnPoolSize int
+	// UDPSockets is how many UDP sockets are kept open to each resolver
+	// for later Raw queries to reuse, one query at a time per socket.
+	// Zero opens a new socket for every query. It needs Raw.
+	UDPSockets int
+	// RateJitter moves each query paced by RateLimit or GlobalRate up to
+	// this fraction of the interval between queries earlier or later, at
+	// random, so the traffic doesn't arrive in lockstep. The average rate
+	// is unchanged. Zero keeps the spacing even.
+	RateJitter float64
+	// MaxQueries is the most PTR queries ever sent, retries included.
+	// Zero means no limit.
+	MaxQueries int64
+
+	// Cache, when set, answers IPs that already resolved without
+	// querying again.
+	Cache *Cache
+
+	// SlowQuery logs a warning for every PTR query that takes longer
+	// than this, with the IP and resolver. Zero logs none.
+	SlowQuery time.Duration
+
+	// Logger receives resolvers being ejected and restored at info level
+	// and slow queries as warnings. Nothing is logged when it is nil.
+	Logger *slog.Logger
+}
+
+// Stats counts what a Scanner has done so far.
+type Stats struct {
+	Resolved    int64
+	Failed      int64
+	Processed   int64
+	Validated   int64
+	Unvalidated int64
+	Generic     int64
+	Cached      int64
+	Queries     int64
+	NXDomain    int64
+	ServFail    int64
+	Timeout     int64
+	OtherErrors int64
+	// Truncated counts raw UDP responses with the TC bit set, which were
+	// queried again over TCP.
+	Truncated int64
+	// Dropped counts hostnames left out because of Config.MaxHostnames.
+	Dropped int64
+	// Disagreements counts IPs the resolvers gave different answers for
+	// under Config.QueryAll.
+	Disagreements int64
+}
+
+// Scanner looks up PTR records. It is safe for concurrent use.
+type Scanner struct {
+	cfg     Config
+	stats   Stats
+	health  *resolverHealth
+	generic []*regexp.Regexp
+	doh     *http.Client
+	proxy   proxy.ContextDialer
+	pool    *connPool
+	udpPool *connPool
+
+	globalLimiter *rate.Limiter
+	limiters      map[string]*rate.Limiter
+	inflight      map[string]chan struct{}
+
+	// offset rotates the starting resolver for each lookup so load is
+	// spread across the whole list instead of piling onto the first entry.
+	offset uint64
+	// weights and slots are nil unless Config.Weights gives a resolver
+	// more than the default weight, see nextStart.
+	weights []int
+	slots   []int
+	// queries counts lookups sent to each resolver, indexed like
+	// cfg.Resolvers.
+	queries []int64
+	// succeeded and timeouts count the answered and timed out lookups
+	// to each resolver, indexed the same way.
+	succeeded []int64
+	timeouts  []int64
+
+	queryCapReached chan struct{}
+	queryCapOnce    sync.Once
+}
+
+// NewScanner checks cfg and returns a Scanner using it.
+func NewScanner(cfg Config) (*Scanner, error) {
+	if len(cfg.Resolvers) == 0 {
+		return nil, errors.New("no resolvers given")
+	}
+
+	switch cfg.Protocol {
+	case "":
+		cfg.Protocol = "udp"
+	case "udp", "tcp", "dot":
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", cfg.Protocol)
+	}
+
+	switch cfg.RetryStrategy {
+	case "":
+		cfg.RetryStrategy = "same-first"
+	case "same-first", "rotate-first":
+	default:
+		return nil, fmt.Errorf("unknown retry strategy %q", cfg.RetryStrategy)
+	}
+
+	if cfg.ECS != nil && !cfg.Raw {
+		return nil, errors.New("ECS requires Raw")
+	}
+	if cfg.QueryAll && cfg.RaceResolvers > 1 {
+		return nil, errors.New("QueryAll can't be used with RaceResolvers")
+	}
+	if cfg.NoRecursion && !cfg.Raw {
+		return nil, errors.New("NoRecursion requires Raw")
+	}
+	if cfg.DNSSEC && !cfg.Raw {
+		return nil, errors.New("DNSSEC requires Raw")
+	}
+	if len(cfg.ExtraTypes) > 0 && !cfg.Raw {
+		return nil, errors.New("ExtraTypes requires Raw")
+	}
+	if cfg.UDPSockets > 0 && !cfg.Raw {
+		return nil, errors.New("UDPSockets requires Raw")
+	}
+
+	if cfg.Port == 0 {
+		cfg.Port = 53
+		if cfg.Protocol == "dot" {
+			cfg.Port = 853
+		}
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 100
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.New(slog.DiscardHandler)
+	}
+
+	s := &Scanner{
+		cfg:             cfg,
+		generic:         cfg.GenericPatterns,
+		doh:             &http.Client{Timeout: max(cfg.Timeout, cfg.Timeout6)},
+		queries:         make([]int64, len(cfg.Resolvers)),
+		succeeded:       make([]int64, len(cfg.Resolvers)),
+		timeouts:        make([]int64, len(cfg.Resolvers)),
+		queryCapReached: make(chan struct{}),
+	}
+
+	if cfg.SourceIP != nil {
+		if err := checkSourceIP(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Proxy != nil || cfg.SourceIP != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = (&net.Dialer{Timeout: cfg.Timeout, LocalAddr: s.localAddr("tcp")}).DialContext
+		if cfg.Proxy != nil {
+			transport.Proxy = http.ProxyURL(cfg.Proxy)
+		}
+		s.doh.Transport = transport
+	}
+
+	if cfg.Proxy != nil {
+		if cfg.Protocol == "udp" {
+			return nil, errors.New("a SOCKS5 proxy can't carry UDP, use the tcp or dot protocol")
+		}
+		dialer, err := proxy.FromURL(cfg.Proxy, &net.Dialer{Timeout: cfg.Timeout, LocalAddr: s.localAddr("tcp")})
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %w", err)
+		}
+		s.proxy = dialer.(proxy.ContextDialer)
+	}
+
+	if s.generic == nil {
+		s.generic = defaultGenericPatterns()
+	}
+
+	if cfg.EjectAfter > 0 {
+		s.health = newResolverHealth(cfg.Resolvers, cfg.EjectAfter, cfg.EjectCooldown, cfg.Logger)
+	}
+
+	if s.weights = resolverWeights(cfg.Resolvers, cfg.Weights); s.weights != nil {
+		s.slots = weightedSlots(s.weights)
+	}
+
+	if cfg.GlobalRate > 0 {
+		s.globalLimiter = rate.NewLimiter(rate.Limit(cfg.GlobalRate), 1)
+	}
+
+	if cfg.RateLimit > 0 {
+		s.limiters = make(map[string]*rate.Limiter, len(cfg.Resolvers))
+		for _, resolverIP := range cfg.Resolvers {
+			s.limiters[resolverIP] = rate.NewLimiter(rate.Limit(cfg.RateLimit), 1)
+		}
+	}
+
+	if cfg.ConnPoolSize > 0 {
+		s.pool = newConnPool(cfg.ConnPoolSize, true)
+	}
+	if cfg.UDPSockets > 0 {
+		s.udpPool = newConnPool(cfg.UDPSockets, false)
+	}
+
+	// Busy resolvers are skipped in favour of the next one, see resolve
+	if cfg.MaxInflight > 0 {
+		s.inflight = make(map[string]chan struct{}, len(cfg.Resolvers))
+		for _, resolverIP := range cfg.Resolvers {
+			s.inflight[resolverIP] = make(chan struct{}, cfg.MaxInflight)
+		}
+	}
+
+	return s, nil
+}
+
+// Close closes the idle connections and sockets kept for reuse by
+// Config.ConnPoolSize, Config.UDPSockets and DNS-over-HTTPS. The Scanner
+// still works afterwards, opening new ones as needed.
+func (s *Scanner) Close() {
+	if s.pool != nil {
+		s.pool.closeIdle()
+	}
+	if s.udpPool != nil {
+		s.udpPool.closeIdle()
+	}
+	if s.doh != nil {
+		s.doh.CloseIdleConnections()
+	}
+}
+
+// Stats returns a snapshot of the scanner's counters.
+func (s *Scanner) Stats() Stats {
+	return Stats{
+		Resolved:      atomic.LoadInt64(&s.stats.Resolved),
+		Failed:        atomic.LoadInt64(&s.stats.Failed),
+		Processed:     atomic.LoadInt64(&s.stats.Processed),
+		Validated:     atomic.LoadInt64(&s.stats.Validated),
+		Unvalidated:   atomic.LoadInt64(&s.stats.Unvalidated),
+		Generic:       atomic.LoadInt64(&s.stats.Generic),
+		Cached:        atomic.LoadInt64(&s.stats.Cached),
+		Queries:       atomic.LoadInt64(&s.stats.Queries),
+		NXDomain:      atomic.LoadInt64(&s.stats.NXDomain),
+		ServFail:      atomic.LoadInt64(&s.stats.ServFail),
+		Timeout:       atomic.LoadInt64(&s.stats.Timeout),
+		OtherErrors:   atomic.LoadInt64(&s.stats.OtherErrors),
+		Truncated:     atomic.LoadInt64(&s.stats.Truncated),
+		Dropped:       atomic.LoadInt64(&s.stats.Dropped),
+		Disagreements: atomic.LoadInt64(&s.stats.Disagreements),
+	}
+}
+
+// ResolverQueries returns the number of queries sent to each resolver,
+// indexed like Config.Resolvers.
+func (s *Scanner) ResolverQueries() []int64 {
+	counts := make([]int64, len(s.queries))
+	for i := range s.queries {
+		counts[i] = atomic.LoadInt64(&s.queries[i])
+	}
+	return counts
+}
+
+// ResolverStats counts the lookups sent to one resolver.
+type ResolverStats struct {
+	Resolver string
+	Queries  int64
+	// Succeeded counts lookups that returned without an error, whether
+	// or not they had any PTR records.
+	Succeeded int64
+	Timeouts  int64
+}
+
+// ResolverStats returns the lookups sent to each resolver so far, indexed
+// like Config.Resolvers.
+func (s *Scanner) ResolverStats() []ResolverStats {
+	stats := make([]ResolverStats, len(s.cfg.Resolvers))
+	for i, resolverIP := range s.cfg.Resolvers {
+		stats[i] = ResolverStats{
+			Resolver:  resolverIP,
+			Queries:   atomic.LoadInt64(&s.queries[i]),
+			Succeeded: atomic.LoadInt64(&s.succeeded[i]),
+			Timeouts:  atomic.LoadInt64(&s.timeouts[i]),
+		}
+	}
+	return stats
+}
+
+// QueryCapReached is closed once Config.MaxQueries queries have been sent.
+func (s *Scanner) QueryCapReached() <-chan struct{} {
+	return s.queryCapReached
+}
+
+// queryCapHit reports whether MaxQueries has been reached.
+func (s *Scanner) queryCapHit() bool {
+	select {
+	case <-s.queryCapReached:
+		return true
+	default:
+		return false
+	}
+}
+
+// Resolve looks up the PTR records for ip. The returned error is the
+// lookup failure, also found in Result.Err, or the reason the IP was
+// skipped: ctx being done or ErrMaxQueries.
+func (s *Scanner) Resolve(ctx context.Context, ip string) (Result, error) {
+	result := s.resolve(ctx, ip, nil)
+	if result.Skipped {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		return result, ErrMaxQueries
+	}
+	return result, result.Err
+}
+
+// LookupHost returns the addresses hostname resolves to, asking each
+// resolver in turn until one answers. A resolver reporting that the name
+// doesn't exist is believed. It isn't counted in Stats or MaxQueries.
+func (s *Scanner) LookupHost(ctx context.Context, hostname string) ([]string, error) {
+	resolvers := s.cfg.Resolvers
+	start := s.nextStart()
+
+	lastErr := errors.New("no usable resolvers")
+	for i := range resolvers {
+		resolverIP := resolvers[(start+i)%len(resolvers)]
+		if !s.health.usable(resolverIP) {
+			continue
+		}
+
+		addrs, err := s.lookupHost(ctx, s.netResolver(resolverIP), resolverIP, hostname)
+		if err == nil {
+			return addrs, nil
+		}
+		lastErr = err
+
+		var dnsErr *net.DNSError
+		if ctx.Err() != nil || (errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// Run looks up the IP of every Target received from targets with
+// Config.Workers lookups at once, sending a Result for each to results.
+// It returns once targets is closed and drained, or once ctx is done or
+// Config.MaxQueries is reached, after sending Skipped results for IPs
+// taken but not looked up. results is left open.
+func (s *Scanner) Run(ctx context.Context, targets <-chan Target, results chan<- Result) {
+	// The orders are drawn up front so a given seed is reproducible
+	var rng *rand.Rand
+	if s.cfg.ShuffleResolvers {
+		seed := s.cfg.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		rng = rand.New(rand.NewSource(seed))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < s.cfg.Workers; i++ {
+		var order []int
+		if rng != nil {
+			order = s.shuffledOrder(rng)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range targets {
+				result := s.resolve(ctx, target.IP, order)
+				result.Comment = target.Comment
+				results <- result
+				if result.Skipped {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Probe sends a single PTR query for ip to resolverIP and reports how long
+// the answer took. It skips the cache, retries, rate limits and health
+// tracking, and isn't counted in Stats, so it can be used to measure a
+// resolver without affecting a run.
+func (s *Scanner) Probe(ctx context.Context, resolverIP, ip string) ([]string, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout(ip))
+	defer cancel()
+
+	sent := time.Now()
+	answer, err := s.lookupPTR(ctx, s.netResolver(resolverIP), resolverIP, ip)
+	elapsed := time.Since(sent)
+	if err != nil {
+		return nil, elapsed, err
+	}
+	return answer.hostnames, elapsed, nil
+}
+
+// queryTimeout returns how long a PTR query for ip may take, which is
+// Config.Timeout6 for IPv6 addresses when it is set.
+func (s *Scanner) queryTimeout(ip string) time.Duration {
+	if s.cfg.Timeout6 > 0 && strings.Contains(ip, ":") {
+		return s.cfg.Timeout6
+	}
+	return s.cfg.Timeout
+}
+
+// lookupPTR sends one PTR query for ip to resolverIP, over DoH, raw DNS
+// or r depending on the resolver and Config.Raw.
+func (s *Scanner) lookupPTR(ctx context.Context, r *net.Resolver, resolverIP, ip string) (*ptrAnswer, error) {
+	if IsDoH(resolverIP) {
+		return s.dohLookupPTR(ctx, resolverIP, ip)
+	}
+	if s.cfg.Raw {
+		return s.rawLookupPTR(ctx, resolverIP, ip)
+	}
+
+	addr, err := r.LookupAddr(ctx, ip)
+	if err != nil {
+		return nil, err
+	}
+	answer := &ptrAnswer{hostnames: make([]string, len(addr))}
+	for i, a := range addr {
+		answer.hostnames[i] = strings.TrimRight(a, ".")
+	}
+	return answer, nil
+}
+
+// waitLimiter waits for limiter to allow the next event, moved by up to
+// RateJitter of the limiter's interval either way.
+func (s *Scanner) waitLimiter(ctx context.Context, limiter *rate.Limiter) error {
+	if s.cfg.RateJitter <= 0 {
+		return limiter.Wait(ctx)
+	}
+
+	// The reservation keeps the bucket's own timing, so the jitter
+	// averages out instead of slowing the rate down
+	reservation := limiter.Reserve()
+	interval := float64(time.Second) / float64(limiter.Limit())
+	delay := reservation.Delay() + time.Duration((rand.Float64()*2-1)*s.cfg.RateJitter*interval)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		reservation.Cancel()
+		return ctx.Err()
+	}
+}
+
+// takeQuery counts a query about to be sent. It returns false, without
+// counting it, when MaxQueries has already been reached.
+func (s *Scanner) takeQuery() bool {
+	for {
+		n := atomic.LoadInt64(&s.stats.Queries)
+		if s.cfg.MaxQueries > 0 && n >= s.cfg.MaxQueries {
+			s.queryCapOnce.Do(func() { close(s.queryCapReached) })
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&s.stats.Queries, n, n+1) {
+			return true
+		}
+	}
+}
+
+// resolve looks up ip, walking the resolvers in order when one is given
+// and from a rotating starting point otherwise.
+func (s *Scanner) resolve(ctx context.Context, ip string, order []int) Result {
+	resolvers := s.cfg.Resolvers
+
+	// Stop taking new work once shutdown has started
+	if ctx.Err() != nil {
+		return Result{IP: ip, Skipped: true}
+	}
+
+	// Repeat the output of an earlier lookup without querying again
+	if cached, ok := s.cfg.Cache.Get(ip); ok && (!s.cfg.Validate || len(cached.Verified) == len(cached.Hostnames)) {
+		atomic.AddInt64(&s.stats.Cached, 1)
+		atomic.AddInt64(&s.stats.Resolved, 1)
+		atomic.AddInt64(&s.stats.Processed, 1)
+		return cached
+	}
+
+	// Apply rate limiting if configured
+	if s.globalLimiter != nil {
+		if err := s.waitLimiter(ctx, s.globalLimiter); err != nil {
+			return Result{IP: ip, Skipped: true}
+		}
+	}
+
+	var lastErr error
+	// A shuffled worker always walks its own order, otherwise the
+	// starting resolver rotates across all lookups
+	start := 0
+	if order == nil {
+		start = s.nextStart()
+		if s.cfg.GroupBy24 {
+			if s.slots != nil {
+				if slot, ok := blockResolver(ip, len(s.slots)); ok {
+					start = s.slots[slot]
+				}
+			} else if idx, ok := blockResolver(ip, len(resolvers)); ok {
+				start = idx
+			}
+		}
+	}
+
+	// Every attempt for this IP shares one deadline when PerIPTimeout is
+	// set. It hangs off ctx so shutdown cancels queries in flight.
+	ipCtx, ipCancel := context.WithCancel(ctx)
+	if s.cfg.PerIPTimeout > 0 {
+		ipCtx, ipCancel = context.WithTimeout(ctx, s.cfg.PerIPTimeout)
+	}
+	defer ipCancel()
+
+	if s.cfg.RaceResolvers > 1 {
+		var candidates []int
+		for i := range resolvers {
+			idx := (start + i) % len(resolvers)
+			if order != nil {
+				idx = order[i]
+			}
+			if s.health.usable(resolvers[idx]) {
+				candidates = append(candidates, idx)
+			}
+			if len(candidates) == s.cfg.MaxResolvers {
+				break
+			}
+		}
+		return s.race(ctx, ipCtx, ip, candidates)
+	}
+
+	// With rotate-first the retries are spent as further passes over
+	// the whole list rather than on each resolver in turn
+	attempts, passes := s.cfg.RetriesPerResolver, 1
+	if s.cfg.RetryStrategy == "rotate-first" {
+		attempts, passes = 0, s.cfg.RetriesPerResolver+1
+	}
+
+	// The resolvers queried for this IP so far, when MaxResolvers limits
+	// how many it gets
+	var tried map[int]bool
+	if s.cfg.MaxResolvers > 0 && s.cfg.MaxResolvers < len(resolvers) {
+		tried = make(map[int]bool, s.cfg.MaxResolvers)
+	}
+
+	// With QueryAll the answer of every resolver is kept, and a resolver
+	// that has given one isn't asked again on a later pass
+	var answers []resolverAnswer
+	var answered map[int]bool
+	if s.cfg.QueryAll {
+		answered = make(map[int]bool, len(resolvers))
+	}
+
+	// Resolvers skipped because they were busy are queued again at
+	// the end, where they are waited for instead
+	queue := make([]int, 0, len(resolvers)*passes)
+	for pass := 0; pass < passes; pass++ {
+		for i := range resolvers {
+			if order != nil {
+				queue = append(queue, order[i])
+			} else {
+				queue = append(queue, (start+i)%len(resolvers))
+			}
+		}
+	}
+	planned := len(queue)
+
+resolverLoop:
+	for n := 0; n < len(queue); n++ {
+		idx := queue[n]
+		revisit := n >= planned
+		resolverIP := resolvers[idx]
+		if !s.health.usable(resolverIP) {
+			continue
+		}
+		if tried != nil && !tried[idx] && len(tried) >= s.cfg.MaxResolvers {
+			continue
+		}
+		if answered[idx] {
+			continue
+		}
+
+		for retry := 0; retry <= attempts; retry++ {
+			// Abandon the IP rather than report a bogus failure
+			if ctx.Err() != nil {
+				return Result{IP: ip, Skipped: true}
+			}
+
+			if ipCtx.Err() != nil {
+				lastErr = ErrPerIPTimeout
+				break resolverLoop
+			}
+
+			if limiter := s.limiters[resolverIP]; limiter != nil {
+				if err := s.waitLimiter(ctx, limiter); err != nil {
+					return Result{IP: ip, Skipped: true}
+				}
+			}
+
+			// Take an in-flight slot for the resolver. A busy resolver
+			// is skipped for the next one the first time round.
+			slots := s.inflight[resolverIP]
+			if slots != nil {
+				if revisit {
+					select {
+					case slots <- struct{}{}:
+					case <-ctx.Done():
+						return Result{IP: ip, Skipped: true}
+					case <-ipCtx.Done():
+						lastErr = ErrPerIPTimeout
+						break resolverLoop
+					}
+				} else {
+					select {
+					case slots <- struct{}{}:
+					default:
+						queue = append(queue, idx)
+						continue resolverLoop
+					}
+				}
+			}
+
+			// Once MaxQueries is used up the IP is left unprocessed
+			if !s.takeQuery() {
+				if slots != nil {
+					<-slots
+				}
+				return Result{IP: ip, Skipped: true}
+			}
+
+			queryCtx, cancel := context.WithTimeout(ipCtx, s.queryTimeout(ip))
+
+			r := s.netResolver(resolverIP)
+
+			if tried != nil {
+				tried[idx] = true
+			}
+			sent := time.Now()
+			answer, err := s.lookupPTR(queryCtx, r, resolverIP, ip)
+			cancel()
+			if slots != nil {
+				<-slots
+			}
+
+			// A query cut short by shutdown says nothing about the
+			// resolver
+			if ctx.Err() != nil {
+				return Result{IP: ip, Skipped: true}
+			}
+			s.recordAttempt(idx, ip, err, time.Since(sent))
+
+			if err == nil && len(answer.hostnames) > 0 {
+				if answered == nil {
+					return s.resolved(ctx, ipCtx, ip, resolverIP, r, answer)
+				}
+				answered[idx] = true
+				answers = append(answers, resolverAnswer{idx: idx, r: r, answer: answer})
+				continue resolverLoop
+			}
+
+			if err == nil {
+				err = ErrNoPTR
+			}
+			lastErr = err
+
+			// Asking again won't make a PTR appear
+			if Classify(err) == StatusNXDomain {
+				if answered == nil {
+					break resolverLoop
+				}
+				answered[idx] = true
+				answers = append(answers, resolverAnswer{idx: idx, err: err})
+				continue resolverLoop
+			}
+
+			// Small delay between retries
+			if retry < attempts {
+				select {
+				case <-time.After(100 * time.Millisecond):
+				case <-ipCtx.Done():
+				}
+			}
+		}
+	}
+
+	if s.cfg.QueryAll {
+		return s.mergeAnswers(ctx, ipCtx, ip, answers, lastErr)
+	}
+	return s.failed(ip, lastErr)
+}
+
+// recordAttempt counts a query for ip sent to the resolver at idx, which
+// took elapsed and failed with err if it isn't nil.
+func (s *Scanner) recordAttempt(idx int, ip string, err error, elapsed time.Duration) {
+	resolverIP := s.cfg.Resolvers[idx]
+	atomic.AddInt64(&s.queries[idx], 1)
+	s.health.record(resolverIP, err)
+	switch {
+	case err == nil:
+		atomic.AddInt64(&s.succeeded[idx], 1)
+	case Classify(err) == StatusTimeout:
+		atomic.AddInt64(&s.timeouts[idx], 1)
+	}
+	if s.cfg.SlowQuery > 0 && elapsed > s.cfg.SlowQuery {
+		s.cfg.Logger.Warn("Slow query", "ip", ip, "resolver", resolverIP, "elapsed", elapsed.Round(time.Millisecond))
+	}
+}
+
+// resolved builds the Result for the PTR records resolverIP returned for
+// ip, applying SkipGeneric, MaxHostnames and Validate and looking up
+// ExtraTypes, and caches and counts it. The follow-up lookups run under
+// ipCtx, so PerIPTimeout bounds them too. The IP is skipped instead if
+// ctx ends during them, and fails with ErrPerIPTimeout if ipCtx does.
+func (s *Scanner) resolved(ctx, ipCtx context.Context, ip, resolverIP string, r *net.Resolver, answer *ptrAnswer) Result {
+	// The IP still counts as resolved when every name turns out to be
+	// generic, there is just nothing to print
+	if s.cfg.SkipGeneric {
+		s.filterGeneric(answer, ip)
+	}
+	dropped := 0
+	if max := s.cfg.MaxHostnames; max > 0 && len(answer.hostnames) > max {
+		dropped = len(answer.hostnames) - max
+		answer.hostnames = answer.hostnames[:max]
+		if answer.ttls != nil {
+			answer.ttls = answer.ttls[:max]
+		}
+	}
+
+	result := Result{
+		IP:        ip,
+		Hostnames: answer.hostnames,
+		TTLs:      answer.ttls,
+		Authority: answer.authority,
+		Truncated: answer.truncated,
+		Dropped:   dropped,
+		Resolver:  resolverIP,
+	}
+
+	if s.cfg.Validate {
+		result.Verified = make([]bool, len(result.Hostnames))
+		for i, hostname := range result.Hostnames {
+			result.Verified[i] = s.forwardConfirm(ipCtx, r, resolverIP, hostname, ip)
+		}
+		// Rather than report names as unconfirmed that were never
+		// checked
+		if ctx.Err() != nil {
+			return Result{IP: ip, Skipped: true}
+		}
+		if ipCtx.Err() != nil {
+			return s.failed(ip, ErrPerIPTimeout)
+		}
+		for _, verified := range result.Verified {
+			if verified {
+				atomic.AddInt64(&s.stats.Validated, 1)
+			} else {
+				atomic.AddInt64(&s.stats.Unvalidated, 1)
+			}
+		}
+	}
+
+	if len(s.cfg.ExtraTypes) > 0 {
+		result.Records = s.extraRecords(ipCtx, resolverIP, result.Hostnames)
+		if ctx.Err() != nil {
+			return Result{IP: ip, Skipped: true}
+		}
+		if ipCtx.Err() != nil {
+			return s.failed(ip, ErrPerIPTimeout)
+		}
+	}
+	atomic.AddInt64(&s.stats.Dropped, int64(dropped))
+
+	s.cfg.Cache.Add(result)
+	atomic.AddInt64(&s.stats.Resolved, 1)
+	atomic.AddInt64(&s.stats.Processed, 1)
+	return result
+}
+
+// failed counts ip as failed with lastErr, or as having had no usable
+// resolvers if that is nil, and returns its Result.
+func (s *Scanner) failed(ip string, lastErr error) Result {
+	if lastErr == nil {
+		lastErr = errors.New("no usable resolvers")
+	}
+	atomic.AddInt64(&s.stats.Failed, 1)
+	s.countFailure(Classify(lastErr), 1)
+	atomic.AddInt64(&s.stats.Processed, 1)
+	return Result{IP: ip, Err: lastErr}
+}
+
+// Uncount takes a failed Result back out of Stats, for an IP that is
+// about to be looked up again, so that it is only counted once with its
+// final outcome. Queries sent for it stay counted.
+func (s *Scanner) Uncount(result Result) {
+	if result.Err == nil || result.Skipped {
+		return
+	}
+	atomic.AddInt64(&s.stats.Failed, -1)
+	s.countFailure(Classify(result.Err), -1)
+	atomic.AddInt64(&s.stats.Processed, -1)
+}
+
+// countFailure adds delta to the counter for a failure category.
+func (s *Scanner) countFailure(status string, delta int64) {
+	switch status {
+	case StatusNXDomain:
+		atomic.AddInt64(&s.stats.NXDomain, delta)
+	case StatusServFail:
+		atomic.AddInt64(&s.stats.ServFail, delta)
+	case StatusTimeout:
+		atomic.AddInt64(&s.stats.Timeout, delta)
+	default:
+		atomic.AddInt64(&s.stats.OtherErrors, delta)
+	}
+}
+
+// blockResolver picks which of n resolvers, or slots of the weighted
+// cycle, every address in ip's /24 starts with, so the resolver's cached
+// delegation for the block is reused. ok is false for IPv6 addresses,
+// which aren't grouped.
+func blockResolver(ip string, n int) (int, bool) {
+	v4 := net.ParseIP(ip).To4()
+	if v4 == nil {
+		return 0, false
+	}
+	hash := uint32(v4[0])<<16 | uint32(v4[1])<<8 | uint32(v4[2])
+	return int(hash % uint32(n)), true
+}
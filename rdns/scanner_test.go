@@ -0,0 +1,201 @@
+package rdns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startServer runs handler on a local UDP and TCP port until the test
+// ends and returns its address, for use as a resolver.
+func startServer(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+
+	// The TCP listener needs the port the UDP one was given, which may
+	// already be taken
+	var pc net.PacketConn
+	var l net.Listener
+	for {
+		var err error
+		if pc, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if l, err = net.Listen("tcp", pc.LocalAddr().String()); err == nil {
+			break
+		}
+		pc.Close()
+	}
+
+	for _, server := range []*dns.Server{{PacketConn: pc, Handler: handler}, {Listener: l, Handler: handler}} {
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+		go server.ActivateAndServe()
+		<-started
+		t.Cleanup(func() { server.Shutdown() })
+	}
+	return pc.LocalAddr().String()
+}
+
+// ptrHandler answers PTR queries for 192.0.2.0/24 by the last octet of
+// the address: 1 doesn't exist, 2 never gets an answer and anything
+// else is host-<octet>.example.com.
+func ptrHandler(w dns.ResponseWriter, req *dns.Msg) {
+	octet, _, _ := strings.Cut(req.Question[0].Name, ".")
+	if octet == "2" {
+		return
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	if octet == "1" {
+		resp.Rcode = dns.RcodeNameError
+	} else {
+		resp.Answer = append(resp.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 300},
+			Ptr: "host-" + octet + ".example.com.",
+		})
+	}
+	w.WriteMsg(resp)
+}
+
+func newTestScanner(t *testing.T, cfg Config) *Scanner {
+	t.Helper()
+
+	scanner, err := NewScanner(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return scanner
+}
+
+func TestResolve(t *testing.T) {
+	resolver := startServer(t, ptrHandler)
+
+	tests := []struct {
+		ip        string
+		hostnames []string
+		status    string
+	}{
+		{"192.0.2.10", []string{"host-10.example.com"}, ""},
+		{"192.0.2.1", nil, StatusNXDomain},
+		{"192.0.2.2", nil, StatusTimeout},
+	}
+
+	for _, raw := range []bool{false, true} {
+		scanner := newTestScanner(t, Config{Resolvers: []string{resolver}, Timeout: 200 * time.Millisecond, Raw: raw})
+		for _, tt := range tests {
+			result, err := scanner.Resolve(context.Background(), tt.ip)
+			if tt.status == "" && err != nil {
+				t.Errorf("raw=%v: Resolve(%s) failed: %v", raw, tt.ip, err)
+				continue
+			}
+			if status := Classify(err); tt.status != "" && status != tt.status {
+				t.Errorf("raw=%v: Resolve(%s) failed with %q (%v), want %q", raw, tt.ip, status, err, tt.status)
+			}
+			if !reflect.DeepEqual(result.Hostnames, tt.hostnames) {
+				t.Errorf("raw=%v: Resolve(%s) = %v, want %v", raw, tt.ip, result.Hostnames, tt.hostnames)
+			}
+			if result.Err != err {
+				t.Errorf("raw=%v: Resolve(%s) returned %v but Result.Err is %v", raw, tt.ip, err, result.Err)
+			}
+		}
+
+		stats := scanner.Stats()
+		if stats.Resolved != 1 || stats.NXDomain != 1 || stats.Timeout != 1 {
+			t.Errorf("raw=%v: got %+v, want 1 resolved, 1 NXDOMAIN and 1 timeout", raw, stats)
+		}
+	}
+}
+
+func TestResolveCancelled(t *testing.T) {
+	resolver := startServer(t, ptrHandler)
+	scanner := newTestScanner(t, Config{Resolvers: []string{resolver}, Timeout: 5 * time.Second})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	result, err := scanner.Resolve(ctx, "192.0.2.2")
+	if !errors.Is(err, context.Canceled) || !result.Skipped {
+		t.Errorf("got %+v, %v, want a skipped result and context.Canceled", result, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Resolve took %v to notice the cancellation", elapsed)
+	}
+}
+
+func TestRun(t *testing.T) {
+	resolver := startServer(t, ptrHandler)
+	scanner := newTestScanner(t, Config{Resolvers: []string{resolver}, Timeout: 200 * time.Millisecond, Workers: 4})
+
+	targets := make(chan Target)
+	results := make(chan Result)
+	go func() {
+		scanner.Run(context.Background(), targets, results)
+		close(results)
+	}()
+	go func() {
+		for _, ip := range []string{"192.0.2.1", "192.0.2.3", "192.0.2.4", "192.0.2.5"} {
+			targets <- Target{IP: ip, Comment: "lab"}
+		}
+		close(targets)
+	}()
+
+	got := make(map[string]Result)
+	for result := range results {
+		got[result.IP] = result
+	}
+	if len(got) != 4 {
+		t.Fatalf("got %d results, want 4", len(got))
+	}
+	for _, octet := range []string{"3", "4", "5"} {
+		result := got["192.0.2."+octet]
+		if want := []string{"host-" + octet + ".example.com"}; result.Err != nil || !reflect.DeepEqual(result.Hostnames, want) {
+			t.Errorf("192.0.2.%s: got %v, %v, want %v", octet, result.Hostnames, result.Err, want)
+		}
+		if result.Comment != "lab" {
+			t.Errorf("192.0.2.%s: lost its comment, got %q", octet, result.Comment)
+		}
+	}
+	if status := Classify(got["192.0.2.1"].Err); status != StatusNXDomain {
+		t.Errorf("192.0.2.1: failed with %q, want %q", status, StatusNXDomain)
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	resolver := startServer(t, ptrHandler)
+	scanner := newTestScanner(t, Config{Resolvers: []string{resolver}, Timeout: 5 * time.Second, Workers: 2})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	targets := make(chan Target, 2)
+	targets <- Target{IP: "192.0.2.2"}
+	targets <- Target{IP: "192.0.2.2"}
+	close(targets)
+	results := make(chan Result, 2)
+
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	scanner.Run(ctx, targets, results)
+	close(results)
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Run took %v to notice the cancellation", elapsed)
+	}
+	if len(results) != 2 {
+		t.Errorf("got %d results, want 2", len(results))
+	}
+	for result := range results {
+		if !result.Skipped {
+			t.Errorf("%s: got %+v, want it skipped", result.IP, result)
+		}
+	}
+	if processed := scanner.Stats().Processed; processed != 0 {
+		t.Errorf("counted %d processed, want none", processed)
+	}
+}
@@ -0,0 +1,82 @@
+package rdns
+
+import (
+	"math/rand"
+	"sort"
+	"sync/atomic"
+)
+
+// resolverWeights returns the weight of each resolver, indexed like
+// resolvers, or nil if every one of them has the default weight of 1.
+func resolverWeights(resolvers []string, weights map[string]int) []int {
+	var w []int
+	for i, resolverIP := range resolvers {
+		if n := weights[resolverIP]; n > 1 {
+			if w == nil {
+				w = make([]int, len(resolvers))
+				for j := range w {
+					w[j] = 1
+				}
+			}
+			w[i] = n
+		}
+	}
+	return w
+}
+
+// weightedSlots spreads the resolver indices over a cycle with each one
+// appearing as many times as its weight, interleaved rather than in runs
+// so a heavy resolver doesn't take several lookups in a row. This is the
+// smooth weighted round robin nginx uses.
+func weightedSlots(weights []int) []int {
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+
+	current := make([]int, len(weights))
+	slots := make([]int, 0, total)
+	for len(slots) < total {
+		best := 0
+		for i, w := range weights {
+			current[i] += w
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		slots = append(slots, best)
+	}
+	return slots
+}
+
+// nextStart picks the resolver a lookup starts on, rotating through the
+// list, or through the weighted cycle when Config.Weights is set.
+func (s *Scanner) nextStart() int {
+	n := atomic.AddUint64(&s.offset, 1)
+	if s.slots != nil {
+		return s.slots[n%uint64(len(s.slots))]
+	}
+	return int(n % uint64(len(s.cfg.Resolvers)))
+}
+
+// shuffledOrder draws a random resolver order for a worker with
+// Config.ShuffleResolvers. With weights each resolver is that much more
+// likely to come before the others: it is placed by an exponential draw
+// scaled down by its weight, and the lowest draw goes first.
+func (s *Scanner) shuffledOrder(rng *rand.Rand) []int {
+	if s.weights == nil {
+		return rng.Perm(len(s.cfg.Resolvers))
+	}
+
+	order := make([]int, len(s.weights))
+	keys := make([]float64, len(s.weights))
+	for i, w := range s.weights {
+		order[i] = i
+		keys[i] = rng.ExpFloat64() / float64(w)
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return keys[order[a]] < keys[order[b]]
+	})
+	return order
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/vijay922/rdns/rdns"
+)
+
+// failureRetrier sits between the scanner and the result writer for
+// --retry-failed-passes. It holds back IPs that failed in a way that may
+// clear up, and looks them up again once the main pass is over, writing
+// only their final outcome.
+type failureRetrier struct {
+	scanner *rdns.Scanner
+	stats   *Stats
+	results chan<- rdns.Result
+}
+
+// collect passes results from in on to the writer until in is closed,
+// holding back the failures worth retrying. previous holds the failures
+// being retried by this pass, by IP, and is nil for the main pass. It
+// returns the failures held back and how many of previous resolved.
+func (r *failureRetrier) collect(in <-chan rdns.Result, previous map[string]rdns.Result) ([]rdns.Result, int) {
+	var held []rdns.Result
+	recovered := 0
+	for result := range in {
+		if prev, ok := previous[result.IP]; ok {
+			if result.Skipped {
+				// The run was stopped first, so the last failure stands
+				r.results <- prev
+				continue
+			}
+			r.scanner.Uncount(prev)
+			if result.Err == nil {
+				recovered++
+			}
+		}
+
+		if isRetryable(result) {
+			held = append(held, result)
+			continue
+		}
+		r.results <- result
+	}
+	return held, recovered
+}
+
+// isRetryable reports whether result is a failure another pass might
+// resolve. NXDOMAIN is an answer, so asking again won't help.
+func isRetryable(result rdns.Result) bool {
+	return result.Err != nil && !result.Skipped && rdns.Classify(result.Err) != rdns.StatusNXDomain
+}
+
+// retry looks up held again, then whatever still fails, up to passes
+// times or until ctx is done, and writes the failures that remain.
+func (r *failureRetrier) retry(ctx context.Context, held []rdns.Result, passes int) {
+	for pass := 1; pass <= passes && len(held) > 0 && ctx.Err() == nil; pass++ {
+		previous := make(map[string]rdns.Result, len(held))
+		work := make(chan rdns.Target, len(held))
+		for _, result := range held {
+			previous[result.IP] = result
+			work <- rdns.Target{IP: result.IP, Comment: result.Comment}
+		}
+		close(work)
+
+		passResults := make(chan rdns.Result, cap(r.results))
+		type collected struct {
+			held      []rdns.Result
+			recovered int
+		}
+		done := make(chan collected)
+		go func() {
+			held, recovered := r.collect(passResults, previous)
+			done <- collected{held, recovered}
+		}()
+		r.scanner.Run(ctx, work, passResults)
+		close(passResults)
+
+		result := <-done
+		atomic.AddInt64(&r.stats.recovered, int64(result.recovered))
+		slog.Info("Retry pass finished", "pass", pass, "retried", len(held), "recovered", result.recovered)
+		held = result.held
+
+		// Run stops taking work once ctx is done, so the IPs it never got
+		// to keep their last failure
+		for target := range work {
+			held = append(held, previous[target.IP])
+		}
+	}
+
+	for _, result := range held {
+		r.results <- result
+	}
+}
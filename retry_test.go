@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/vijay922/rdns/rdns"
+)
+
+func TestRetryCancelled(t *testing.T) {
+	// A resolver that never answers, so the pass is still going when it
+	// is cancelled
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	scanner, err := rdns.NewScanner(rdns.Config{Resolvers: []string{pc.LocalAddr().String()}, Timeout: 5 * time.Second, Workers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var held []rdns.Result
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.5"} {
+		held = append(held, rdns.Result{IP: ip, Err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}, Comment: "lab"})
+	}
+
+	results := make(chan rdns.Result, len(held))
+	retrier := &failureRetrier{scanner: scanner, stats: &Stats{}, results: results}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	retrier.retry(ctx, held, 3)
+	close(results)
+
+	var ips []string
+	for result := range results {
+		if result.Err == nil || result.Skipped || result.Comment != "lab" {
+			t.Errorf("%s: got %+v, want its earlier failure", result.IP, result)
+		}
+		ips = append(ips, result.IP)
+	}
+	sort.Strings(ips)
+	if len(ips) != len(held) {
+		t.Fatalf("got failures for %v, want all of %d", ips, len(held))
+	}
+	for i, result := range held {
+		if ips[i] != result.IP {
+			t.Errorf("got failures for %v, want %s among them", ips, result.IP)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// rotatingOutput is the --output file split into numbered files, moving
+// on to the next once one holds --output-rotate-lines lines or
+// --output-rotate-size bytes. The first file has the --output name and
+// the rest add .1, .2 and so on. Files are only split between lines, so
+// it can sit under the output buffer, which writes in arbitrary chunks.
+type rotatingOutput struct {
+	path     string
+	maxLines int64
+	maxBytes int64
+	// header is written at the top of every file, for CSV output.
+	header []byte
+
+	file  *os.File
+	index int
+	lines int64
+	bytes int64
+	// midLine is set when the last write didn't end with a newline.
+	midLine bool
+}
+
+// newRotatingOutput takes over file, already created at path, as the
+// first of the files.
+func newRotatingOutput(file *os.File, path string, maxLines, maxBytes int64) *rotatingOutput {
+	return &rotatingOutput{path: path, maxLines: maxLines, maxBytes: maxBytes, file: file}
+}
+
+// setHeader writes header at the top of the current file, and of every
+// file after it.
+func (r *rotatingOutput) setHeader(header []byte) error {
+	r.header = header
+	return r.writeHeader()
+}
+
+func (r *rotatingOutput) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if !r.midLine && r.full() {
+			if err := r.rotate(); err != nil {
+				return written, err
+			}
+		}
+
+		line := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line = p[:i+1]
+		}
+		n, err := r.file.Write(line)
+		written += n
+		r.bytes += int64(n)
+		if err != nil {
+			return written, err
+		}
+
+		r.midLine = line[len(line)-1] != '\n'
+		if !r.midLine {
+			r.lines++
+		}
+		p = p[len(line):]
+	}
+	return written, nil
+}
+
+// full reports whether the current file has reached either limit. The
+// header isn't counted as a line.
+func (r *rotatingOutput) full() bool {
+	return (r.maxLines > 0 && r.lines >= r.maxLines) || (r.maxBytes > 0 && r.bytes >= r.maxBytes)
+}
+
+// rotate closes the current file and starts the next one.
+func (r *rotatingOutput) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+
+	r.index++
+	file, err := os.Create(fmt.Sprintf("%s.%d", r.path, r.index))
+	if err != nil {
+		return err
+	}
+	r.file, r.lines, r.bytes = file, 0, 0
+	return r.writeHeader()
+}
+
+func (r *rotatingOutput) writeHeader() error {
+	if len(r.header) == 0 {
+		return nil
+	}
+	n, err := r.file.Write(r.header)
+	r.bytes += int64(n)
+	return err
+}
+
+// Close closes the file currently being written.
+func (r *rotatingOutput) Close() error {
+	return r.file.Close()
+}
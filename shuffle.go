@@ -0,0 +1,43 @@
+package main
+
+import (
+	"math/rand"
+
+	"github.com/vijay922/rdns/rdns"
+)
+
+// inputShuffler reorders targets for --shuffle-input. It holds up to
+// --shuffle-window of them and, once full, lets a random one go for each
+// new one that arrives, so memory stays bounded however large the input
+// is. A target can only come out ahead of those up to a window before it.
+type inputShuffler struct {
+	held   []rdns.Target
+	window int
+	rng    *rand.Rand
+}
+
+func newInputShuffler(window int, rng *rand.Rand) *inputShuffler {
+	return &inputShuffler{held: make([]rdns.Target, 0, window), window: window, rng: rng}
+}
+
+// add holds on to target and, once the window is full, returns one of the
+// held targets picked at random in its place. ok is false when nothing is
+// due to be queued yet.
+func (s *inputShuffler) add(target rdns.Target) (next rdns.Target, ok bool) {
+	if len(s.held) < s.window {
+		s.held = append(s.held, target)
+		return rdns.Target{}, false
+	}
+	i := s.rng.Intn(len(s.held))
+	next, s.held[i] = s.held[i], target
+	return next, true
+}
+
+// drain returns the targets still held, in random order, and forgets
+// them.
+func (s *inputShuffler) drain() []rdns.Target {
+	held := s.held
+	s.rng.Shuffle(len(held), func(a, b int) { held[a], held[b] = held[b], held[a] })
+	s.held = nil
+	return held
+}
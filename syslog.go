@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"io"
+)
+
+// syslogOutput sends each line written to it as its own syslog message,
+// for --syslog. Lines can arrive split across writes, since it sits under
+// the output buffer, so a partial line is held until the rest comes.
+type syslogOutput struct {
+	w       io.WriteCloser
+	partial []byte
+}
+
+func (s *syslogOutput) Write(p []byte) (int, error) {
+	written := len(p)
+	for {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			s.partial = append(s.partial, p...)
+			return written, nil
+		}
+		line := append(s.partial, p[:i]...)
+		s.partial = s.partial[:0]
+		p = p[i+1:]
+		if len(line) == 0 {
+			continue
+		}
+		if _, err := s.w.Write(line); err != nil {
+			return written - len(p), err
+		}
+	}
+}
+
+// Close sends any unfinished last line and closes the connection.
+func (s *syslogOutput) Close() error {
+	if len(s.partial) > 0 {
+		if _, err := s.w.Write(s.partial); err != nil {
+			s.w.Close()
+			return err
+		}
+	}
+	return s.w.Close()
+}
@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// dialSyslog fails, since log/syslog isn't available on this platform.
+func dialSyslog(addr, priority string) (io.WriteCloser, error) {
+	return nil, fmt.Errorf("syslog isn't supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,54 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"strings"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON, "auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG,
+	"lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS, "uucp": syslog.LOG_UUCP,
+	"cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3, "local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+var syslogSeverities = map[string]syslog.Priority{
+	"emerg": syslog.LOG_EMERG, "alert": syslog.LOG_ALERT, "crit": syslog.LOG_CRIT,
+	"err": syslog.LOG_ERR, "warning": syslog.LOG_WARNING, "notice": syslog.LOG_NOTICE,
+	"info": syslog.LOG_INFO, "debug": syslog.LOG_DEBUG,
+}
+
+// dialSyslog connects to the syslog daemon at addr, given as host:port for
+// UDP or as udp://host:port or tcp://host:port, or to the local one when
+// addr is empty. Messages are sent at priority, a facility.severity pair
+// like logger -p takes, such as local0.notice.
+func dialSyslog(addr, priority string) (io.WriteCloser, error) {
+	facilityName, severityName, _ := strings.Cut(strings.ToLower(priority), ".")
+	facility, ok := syslogFacilities[facilityName]
+	if !ok {
+		return nil, fmt.Errorf("unknown facility in %q, expected facility.severity such as user.info", priority)
+	}
+	severity, ok := syslogSeverities[severityName]
+	if !ok {
+		return nil, fmt.Errorf("unknown severity in %q, expected facility.severity such as user.info", priority)
+	}
+
+	var network, raddr string
+	if addr != "" {
+		network, raddr = "udp", addr
+		if scheme, rest, found := strings.Cut(addr, "://"); found {
+			if scheme != "udp" && scheme != "tcp" {
+				return nil, fmt.Errorf("unsupported syslog protocol %q, use udp or tcp", scheme)
+			}
+			network, raddr = scheme, rest
+		}
+	}
+	return syslog.Dial(network, raddr, facility|severity, "rdns")
+}
@@ -0,0 +1,59 @@
+package main
+
+import "hash/fnv"
+
+// lineSet remembers the output lines already written for --unique-output.
+type lineSet interface {
+	// add records line and reports whether it is new.
+	add(line string) bool
+}
+
+// exactSet holds every line written, so it never drops a line by mistake
+// but grows with the number of distinct lines.
+type exactSet map[string]struct{}
+
+func (s exactSet) add(line string) bool {
+	if _, ok := s[line]; ok {
+		return false
+	}
+	s[line] = struct{}{}
+	return true
+}
+
+const (
+	// bloomBits is the size of the --unique-approx filter, 16 MiB. It
+	// keeps false positives to about 1% up to 13 million distinct lines.
+	bloomBits   = 1 << 27
+	bloomHashes = 7
+)
+
+// bloomSet is a fixed size Bloom filter for --unique-approx. A line that
+// was never written is occasionally taken for a repeat, but memory use
+// stays the same however long the run.
+type bloomSet struct {
+	bits []uint64
+}
+
+func newBloomSet() *bloomSet {
+	return &bloomSet{bits: make([]uint64, bloomBits/64)}
+}
+
+func (s *bloomSet) add(line string) bool {
+	h := fnv.New64a()
+	h.Write([]byte(line))
+	sum := h.Sum64()
+
+	// Derive the hashes from two halves of one, as in Kirsch and
+	// Mitzenmacher's "Less Hashing, Same Performance"
+	h1, h2 := uint32(sum), uint32(sum>>32)
+	isNew := false
+	for i := uint32(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % bloomBits
+		word, mask := bit/64, uint64(1)<<(bit%64)
+		if s.bits[word]&mask == 0 {
+			isNew = true
+			s.bits[word] |= mask
+		}
+	}
+	return isNew
+}